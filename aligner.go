@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// aligner_profile describes how to run an aligner. Args is a template in
+// which placeholders such as {fastq_1} are filled in for each cram, and the
+// aligner must write its alignments to stdout so that samtools can sort them.
+// Read_group_args, which tag the reads with the cram's read group, are added
+// where Args has {read_group_args}, or at the end. The bams of libraries
+// aligned with an Rna profile are included in the counts matrix.
+// Single_end_args replace Args for single-end crams, which otherwise use Args
+// without any argument that is only {fastq_2}. Stream_args replace both when
+// reads are streamed from the CRAM, as the fastqs are then uncompressed named
+// pipes. Index_files are the files, with {reference} standing for the
+// Reference, that must exist for the reference to be usable. Version_args make
+// the aligner print its version, which is recorded on the bams it uploads.
+type aligner_profile struct {
+	Name            string
+	Exec            string
+	Args            []string
+	Single_end_args []string
+	Stream_args     []string
+	Read_group_args []string
+	Threads         int
+	Memory          int
+	Reference       string
+	Index_files     []string
+	Version_args    []string
+	Rna             bool
+}
+
+var template_placeholder_regex = regexp.MustCompile(`\{([a-z_0-9]+)(?::([^}]+))?\}`)
+
+// placeholders that can be used in an aligner profile's arguments, besides
+// {meta:<attribute>} which is replaced by an attribute of the cram's metadata
+var template_placeholders = []string{
+	"threads", "reference", "fastq_1", "fastq_2", "out_prefix",
+	"read_group", "read_group_id", "rg_id", "rg_sm", "rg_lb", "rg_pl", "rg_pu",
+	"sample", "library_type",
+}
+
+// placeholders that are replaced by several arguments, so must be an argument
+// on their own
+var template_list_placeholders = []string{"{read_group_args}", "{read_group_fields}"}
+
+// builtinAlignerProfiles returns the STAR and BWA profiles, built from the
+// star_* and bwa_* config settings that were used before aligners could be
+// configured.
+func builtinAlignerProfiles() map[string]*aligner_profile {
+	return map[string]*aligner_profile{
+		"star": {
+			Name: "star",
+			Exec: viper.GetString("star_exec"),
+			Args: []string{
+				"--runThreadN", "{threads}",
+				"--outSAMattributes", "NH", "HI", "NM", "MD",
+				"--genomeDir", "{reference}",
+				"--readFilesCommand", "zcat",
+				"--outFileNamePrefix", "{out_prefix}",
+				"--readFilesIn", "{fastq_1}", "{fastq_2}",
+				"--outSAMtype", "BAM", "Unsorted",
+				"--outStd", "BAM_Unsorted",
+			},
+			Stream_args: []string{
+				"--runThreadN", "{threads}",
+				"--outSAMattributes", "NH", "HI", "NM", "MD",
+				"--genomeDir", "{reference}",
+				"--outFileNamePrefix", "{out_prefix}",
+				"--readFilesIn", "{fastq_1}", "{fastq_2}",
+				"--outSAMtype", "BAM", "Unsorted",
+				"--outStd", "BAM_Unsorted",
+			},
+			Read_group_args: []string{"--outSAMattrRGline", "{read_group_fields}"},
+			Threads:         10,
+			Memory:          viper.GetInt("star_ram"),
+			Reference:       viper.GetString("star_genome_dir"),
+			Index_files: []string{
+				"{reference}/Genome", "{reference}/SA", "{reference}/SAindex", "{reference}/chrName.txt",
+			},
+			Version_args: []string{"--version"},
+			Rna:          true,
+		},
+		"bwa": {
+			Name:            "bwa",
+			Exec:            viper.GetString("bwa_exec"),
+			Args:            []string{"mem", "-t", "{threads}", "{read_group_args}", "{reference}", "{fastq_1}", "{fastq_2}"},
+			Read_group_args: []string{"-R", "{read_group}"},
+			Threads:         10,
+			Memory:          viper.GetInt("bwa_ram"),
+			Reference:       viper.GetString("bwa_genome_ref"),
+			Index_files: []string{
+				"{reference}.bwt", "{reference}.pac", "{reference}.ann", "{reference}.amb", "{reference}.sa",
+				"{reference}.fai",
+			},
+		},
+	}
+}
+
+// alignerProfilesFromConfig reads the aligner profiles and the aligner used for
+// each library_type. Profiles given under "aligners" are added to, or replace,
+// the built in star and bwa profiles, and "library_aligners" is added to the
+// mapping given by star_align_libraries and bwa_align_libraries. Config keys
+// are case insensitive, so library_types are matched in lower case.
+func alignerProfilesFromConfig() (map[string]*aligner_profile, map[string]string, error) {
+	profiles := builtinAlignerProfiles()
+	configured := make(map[string]*aligner_profile)
+	if err := viper.UnmarshalKey("aligners", &configured); err != nil {
+		return nil, nil, fmt.Errorf("unable to read aligners: %s", err.Error())
+	}
+	for name, profile := range configured {
+		profile.Name = strings.ToLower(name)
+		profiles[profile.Name] = profile
+	}
+
+	library_aligners := make(map[string]string)
+	for _, library_type := range viper.GetStringSlice("star_align_libraries") {
+		library_aligners[strings.ToLower(library_type)] = "star"
+	}
+	for _, library_type := range viper.GetStringSlice("bwa_align_libraries") {
+		library_aligners[strings.ToLower(library_type)] = "bwa"
+	}
+	for library_type, aligner := range viper.GetStringMapString("library_aligners") {
+		library_aligners[strings.ToLower(library_type)] = strings.ToLower(aligner)
+	}
+
+	for library_type, aligner := range library_aligners {
+		if _, ok := profiles[aligner]; !ok {
+			return nil, nil, fmt.Errorf("library_type '%s' uses unknown aligner '%s'", library_type, aligner)
+		}
+	}
+	for _, profile := range profiles {
+		if err := profile.validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return profiles, library_aligners, nil
+}
+
+// validate checks the profile can be run and only uses known placeholders
+func (a *aligner_profile) validate() error {
+	if a.Exec == "" {
+		return fmt.Errorf("aligner '%s' has no exec", a.Name)
+	}
+	if a.Threads < 1 {
+		a.Threads = 1
+	}
+	var templates []string
+	for _, args := range [][]string{a.Args, a.Single_end_args, a.Stream_args, a.Read_group_args} {
+		templates = append(templates, args...)
+	}
+	for _, arg := range templates {
+		for _, match := range template_placeholder_regex.FindAllStringSubmatch(arg, -1) {
+			if match[1] == "meta" && match[2] != "" {
+				continue
+			}
+			if stringInSlice(match[0], template_list_placeholders) && arg == match[0] {
+				continue
+			}
+			if stringInSlice(match[1], template_placeholders) && match[2] == "" {
+				continue
+			}
+			return fmt.Errorf("aligner '%s' uses unknown placeholder %s", a.Name, match[0])
+		}
+	}
+	for _, index_file := range a.Index_files {
+		for _, match := range template_placeholder_regex.FindAllString(index_file, -1) {
+			if match != "{reference}" {
+				return fmt.Errorf("aligner '%s' index file %s uses placeholder %s, only {reference} can be used",
+					a.Name, index_file, match)
+			}
+		}
+	}
+	return nil
+}
+
+// indexFiles returns the paths of the profile's Index_files
+func (a *aligner_profile) indexFiles() []string {
+	var paths []string
+	for _, index_file := range a.Index_files {
+		paths = append(paths, strings.Replace(index_file, "{reference}", strings.TrimSuffix(a.Reference, "/"), -1))
+	}
+	return paths
+}
+
+// alignerProfile returns the profile the library_type is aligned with, or nil
+// if it isn't aligned
+func (p *pipeline) alignerProfile(library_type string) *aligner_profile {
+	aligner, ok := p.cfg.Library_aligners[strings.ToLower(library_type)]
+	if !ok {
+		return nil
+	}
+	return p.cfg.Aligners[aligner]
+}
+
+// jobPrefix is the prefix of the names of the profile's alignment jobs
+func (a *aligner_profile) jobPrefix() string {
+	if a.Rna {
+		return "D_realignement_RNA_"
+	}
+	return "D_realignement_DNA_"
+}
+
+// command fills in the profile's argument template for the cram, reading its
+// reads from fastq_1 and fastq_2, writing any files the aligner creates
+// besides its alignments under out_prefix, and tagging the reads with the read
+// group rg. Single-end crams have no second fastq, so use Single_end_args if
+// the profile has them, and streamed crams use Stream_args if it has them.
+func (a *aligner_profile) command(
+	cram *cram_file, fastq_1 string, fastq_2 string, out_prefix string, rg read_group, streamed bool,
+) []string {
+	values := map[string]string{
+		"threads":       strconv.Itoa(a.Threads),
+		"reference":     a.Reference,
+		"fastq_1":       fastq_1,
+		"fastq_2":       fastq_2,
+		"out_prefix":    out_prefix,
+		"read_group":    rg.line(),
+		"read_group_id": rg.ID,
+		"rg_id":         rg.ID,
+		"rg_sm":         rg.SM,
+		"rg_lb":         rg.LB,
+		"rg_pl":         rg.PL,
+		"rg_pu":         rg.PU,
+		"sample":        cram.Sample_name,
+		"library_type":  cram.Library_type,
+	}
+	fill := func(args []string, list_values map[string][]string) []string {
+		var filled []string
+		for _, arg := range args {
+			if list_value, ok := list_values[arg]; ok {
+				filled = append(filled, list_value...)
+				continue
+			}
+			if arg == "{fastq_2}" && cram.Single_end {
+				continue
+			}
+			filled = append(filled, template_placeholder_regex.ReplaceAllStringFunc(arg, func(placeholder string) string {
+				match := template_placeholder_regex.FindStringSubmatch(placeholder)
+				if match[1] == "meta" {
+					value, _ := cram.attribute(match[2])
+					return value
+				}
+				return values[match[1]]
+			}))
+		}
+		return filled
+	}
+
+	read_group_args := fill(a.Read_group_args, map[string][]string{"{read_group_fields}": rg.fields()})
+	list_values := map[string][]string{
+		"{read_group_args}":   read_group_args,
+		"{read_group_fields}": rg.fields(),
+	}
+	args := a.Args
+	if cram.Single_end && len(a.Single_end_args) > 0 {
+		args = a.Single_end_args
+	}
+	if streamed && len(a.Stream_args) > 0 {
+		args = a.Stream_args
+	}
+	cmd := append([]string{a.Exec}, fill(args, list_values)...)
+	if !stringInSlice("{read_group_args}", args) {
+		cmd = append(cmd, read_group_args...)
+	}
+	return cmd
+}
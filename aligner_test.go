@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/seanlaidlaw/iRODS-Downloader/irods"
+)
+
+func TestAlignerCommand(t *testing.T) {
+	bwa := &aligner_profile{
+		Name:            "bwa",
+		Exec:            "bwa",
+		Args:            []string{"mem", "-t", "{threads}", "{read_group_args}", "{reference}", "{fastq_1}", "{fastq_2}"},
+		Read_group_args: []string{"-R", "{read_group}"},
+		Threads:         4,
+		Reference:       "genome.fa",
+	}
+	star := &aligner_profile{
+		Name:            "star",
+		Exec:            "STAR",
+		Args:            []string{"--readFilesCommand", "zcat", "--outFileNamePrefix", "{out_prefix}", "--readFilesIn", "{fastq_1}", "{fastq_2}"},
+		Single_end_args: []string{"--single", "{fastq_1}"},
+		Stream_args:     []string{"--outFileNamePrefix", "{out_prefix}", "--readFilesIn", "{fastq_1}", "{fastq_2}"},
+		Read_group_args: []string{"--outSAMattrRGline", "{read_group_fields}"},
+		Threads:         1,
+	}
+	custom := &aligner_profile{
+		Name:    "custom",
+		Exec:    "align",
+		Args:    []string{"--sample={sample}", "--library={meta:library_id}", "--type", "{library_type}", "--id", "{rg_id}", "{fastq_1}"},
+		Threads: 1,
+	}
+
+	rg := read_group{ID: "1234_1#1", SM: "s1", PL: "ILLUMINA", PU: "1234.1.1"}
+	paired := &cram_file{Sample_name: "s1", Library_type: "GnT scRNA", Metadata: []irods.Avu{{Attribute: "library_id", Value: "99"}}}
+	single := &cram_file{Sample_name: "s1", Single_end: true}
+	tests := []struct {
+		aligner  *aligner_profile
+		cram     *cram_file
+		streamed bool
+		want     []string
+	}{
+		{bwa, paired, false, []string{
+			"bwa", "mem", "-t", "4", "-R", `@RG\tID:1234_1#1\tSM:s1\tPL:ILLUMINA\tPU:1234.1.1`, "genome.fa", "1.fq.gz", "2.fq.gz",
+		}},
+		{bwa, single, false, []string{
+			"bwa", "mem", "-t", "4", "-R", `@RG\tID:1234_1#1\tSM:s1\tPL:ILLUMINA\tPU:1234.1.1`, "genome.fa", "1.fq.gz",
+		}},
+		{star, paired, false, []string{
+			"STAR", "--readFilesCommand", "zcat", "--outFileNamePrefix", "out/", "--readFilesIn", "1.fq.gz", "2.fq.gz",
+			"--outSAMattrRGline", "ID:1234_1#1", "SM:s1", "PL:ILLUMINA", "PU:1234.1.1",
+		}},
+		{star, single, false, []string{
+			"STAR", "--single", "1.fq.gz",
+			"--outSAMattrRGline", "ID:1234_1#1", "SM:s1", "PL:ILLUMINA", "PU:1234.1.1",
+		}},
+		{star, paired, true, []string{
+			"STAR", "--outFileNamePrefix", "out/", "--readFilesIn", "1.fq.gz", "2.fq.gz",
+			"--outSAMattrRGline", "ID:1234_1#1", "SM:s1", "PL:ILLUMINA", "PU:1234.1.1",
+		}},
+		{custom, paired, false, []string{
+			"align", "--sample=s1", "--library=99", "--type", "GnT scRNA", "--id", "1234_1#1", "1.fq.gz",
+		}},
+	}
+	for _, test := range tests {
+		got := test.aligner.command(test.cram, "1.fq.gz", "2.fq.gz", "out/", rg, test.streamed)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s command of %+v (streamed %v) = %q, want %q", test.aligner.Name, test.cram, test.streamed, got, test.want)
+		}
+	}
+}
+
+func TestAlignerValidate(t *testing.T) {
+	tests := []struct {
+		aligner aligner_profile
+		fails   bool
+	}{
+		{aligner_profile{Name: "bwa", Exec: "bwa", Args: []string{"mem", "{read_group_args}", "{reference}", "{fastq_1}"}}, false},
+		{aligner_profile{Name: "star", Exec: "STAR", Read_group_args: []string{"--outSAMattrRGline", "{read_group_fields}"}}, false},
+		{aligner_profile{Name: "meta", Exec: "align", Args: []string{"--library={meta:library_id}", "--prefix={out_prefix}"}}, false},
+		{aligner_profile{Name: "index", Exec: "bwa", Index_files: []string{"{reference}.bwt"}}, false},
+		{aligner_profile{Name: "no_exec", Args: []string{"{fastq_1}"}}, true},
+		{aligner_profile{Name: "unknown", Exec: "bwa", Args: []string{"{fastq_3}"}}, true},
+		{aligner_profile{Name: "meta_name", Exec: "bwa", Args: []string{"{meta}"}}, true},
+		{aligner_profile{Name: "argument", Exec: "bwa", Args: []string{"{threads:4}"}}, true},
+		{aligner_profile{Name: "list", Exec: "bwa", Args: []string{"-R{read_group_args}"}}, true},
+		{aligner_profile{Name: "stream", Exec: "bwa", Stream_args: []string{"{fastq}"}}, true},
+		{aligner_profile{Name: "index_placeholder", Exec: "bwa", Index_files: []string{"{fastq_1}.bwt"}}, true},
+	}
+	for _, test := range tests {
+		err := test.aligner.validate()
+		if (err != nil) != test.fails {
+			t.Errorf("validate of aligner %s returned %v", test.aligner.Name, err)
+		}
+	}
+
+	aligner := aligner_profile{Name: "bwa", Exec: "bwa"}
+	if err := aligner.validate(); err != nil || aligner.Threads != 1 {
+		t.Errorf("validate of aligner without threads returned %v and left %d threads, want 1", err, aligner.Threads)
+	}
+}
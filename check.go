@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/seanlaidlaw/iRODS-Downloader/irods"
+)
+
+// preflight_check is the result of checking one part of the configuration,
+// which passed if Err is nil
+type preflight_check struct {
+	Name  string
+	Value string
+	Err   error
+}
+
+// checkExecutable checks the command exists and can be run, looking it up on
+// the PATH if it isn't a path itself
+func checkExecutable(name string) error {
+	if name == "" {
+		return fmt.Errorf("not set")
+	}
+	_, err := exec.LookPath(name)
+	return err
+}
+
+// checkFile checks the path is a regular file that isn't empty
+func checkFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%s is empty", path)
+	}
+	return nil
+}
+
+// checkGtf checks the annotation exists and that its first record has the
+// nine tab separated columns of a GTF file
+func checkGtf(path string) error {
+	if err := checkFile(path); err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(strings.Split(line, "\t")) != 9 {
+			return fmt.Errorf("%s doesn't look like a GTF file, expected 9 tab separated columns", path)
+		}
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s has no records", path)
+}
+
+// preflightChecks checks the executables, references and annotation the
+// config points to, the scheduler's commands and the iRODS credentials, so
+// that a misconfiguration is found before any jobs are submitted rather than
+// inside them. Only the aligners that some library_type is aligned with are
+// checked, featureCounts and its annotation only if RNA is aligned, and the
+// commands that upload to iRODS only if an upload_collection is configured.
+func preflightChecks(cfg pipeline_config, sched scheduler, irods_client irods.Client) []preflight_check {
+	var checks []preflight_check
+	checks = append(checks, preflight_check{"samtools_exec", cfg.Samtools_exec, checkExecutable(cfg.Samtools_exec)})
+
+	var aligners []string
+	for _, aligner := range cfg.Library_aligners {
+		if !stringInSlice(aligner, aligners) {
+			aligners = append(aligners, aligner)
+		}
+	}
+	sort.Strings(aligners)
+
+	counts_rna := false
+	for _, aligner := range aligners {
+		profile := cfg.Aligners[aligner]
+		if profile.Rna {
+			counts_rna = true
+		}
+		checks = append(checks, preflight_check{aligner + " exec", profile.Exec, checkExecutable(profile.Exec)})
+
+		var err error
+		if profile.Reference == "" {
+			err = fmt.Errorf("not set")
+		} else {
+			_, err = os.Stat(profile.Reference)
+		}
+		checks = append(checks, preflight_check{aligner + " reference", profile.Reference, err})
+		for _, index_file := range profile.indexFiles() {
+			checks = append(checks, preflight_check{aligner + " index", index_file, checkFile(index_file)})
+		}
+	}
+
+	if counts_rna {
+		checks = append(checks,
+			preflight_check{"featurecounts_exec", cfg.Featurecounts_exec, checkExecutable(cfg.Featurecounts_exec)},
+			preflight_check{"genome_annot", cfg.Genome_annot, checkGtf(cfg.Genome_annot)},
+		)
+	}
+
+	// every job with several commands is run as a bash script
+	checks = append(checks, preflight_check{"bash", "/bin/bash", checkExecutable("/bin/bash")})
+	for _, command := range sched.Commands() {
+		checks = append(checks, preflight_check{"scheduler", command, checkExecutable(command)})
+	}
+
+	// the commands jobs transfer data with
+	irods_commands := [][]string{irods_client.DownloadCommand("", "")}
+	if cfg.Upload_collection != "" {
+		irods_commands = append(irods_commands, irods_client.UploadCommand("", ""), irods_client.MkdirCommand(""))
+		irods_commands = append(irods_commands, irods_client.MetadataCommands("", []irods.Avu{{}})...)
+	}
+	var checked []string
+	for _, command := range irods_commands {
+		if !stringInSlice(command[0], checked) {
+			checked = append(checked, command[0])
+			checks = append(checks, preflight_check{"iRODS", command[0], checkExecutable(command[0])})
+		}
+	}
+
+	checks = append(checks, preflight_check{"iRODS authentication", irods_zone, irods_client.CheckAuth()})
+	return checks
+}
+
+// failedChecks returns the checks that didn't pass
+func failedChecks(checks []preflight_check) []preflight_check {
+	var failed []preflight_check
+	for _, check := range checks {
+		if check.Err != nil {
+			failed = append(failed, check)
+		}
+	}
+	return failed
+}
+
+// checkCommand implements "irods_downloader check", running the checks that
+// are made before the pipeline starts and printing the result of each. It
+// exits with a non-zero status if any fail.
+func checkCommand(args []string) {
+	var project_root string
+
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.StringVar(&project_root, "p", ".", "Specify the project root directory")
+	flags.Parse(args)
+
+	cfg, sched, err := loadConfig(project_root)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// relative paths in the config are relative to the project root, as they
+	// are when the pipeline runs
+	if err := os.Chdir(project_root); err != nil {
+		log.Fatalln(err)
+	}
+	checks := preflightChecks(cfg, sched, irods.NewIcommandsClient(irods_zone))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tVALUE\tRESULT")
+	for _, check := range checks {
+		result := "ok"
+		if check.Err != nil {
+			result = check.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", check.Name, check.Value, result)
+	}
+	w.Flush()
+
+	if failed := failedChecks(checks); len(failed) > 0 {
+		log.Fatalf("%d checks failed\n", len(failed))
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/seanlaidlaw/iRODS-Downloader/irods"
+)
+
+const (
+	checksum_ok       = "ok"
+	checksum_mismatch = "mismatch"
+	checksum_missing  = "missing"
+	checksum_unknown  = "unknown"
+	checksum_removed  = "removed"
+)
+
+// Compare the checksum of the downloaded cram, saved by its download job, with
+// the one held by iRODS, as the download job exiting successfully doesn't
+// guarantee the file is intact
+func (p *pipeline) verifyChecksum(cram *cram_file) {
+	checksums, err := readChecksums(checksumsPath(cram))
+	if err != nil {
+		// downloaded before download jobs checksummed their downloads
+		log.Println(err)
+		log.Printf("No checksums were saved for %s, downloading it again\n", cram.Cram_dl_path)
+		cram.Cram_download_success = false
+		cram.Stage = stage_download
+		return
+	}
+
+	irods_checksum, err := p.irods.Checksum(cram.Irods_path)
+	if err != nil {
+		log.Println(err)
+		p.failCram(cram, "unable to fetch iRODS checksum")
+		return
+	}
+	cram.Irods_checksum = irods_checksum
+
+	local_checksum, ok := irods.MatchingChecksum(checksums, irods_checksum)
+	if !ok {
+		p.failCram(cram, "no checksum of the download in the format iRODS uses")
+		return
+	}
+	cram.Local_checksum = local_checksum
+
+	if local_checksum != irods_checksum {
+		log.Printf("Checksum of %s is %s but iRODS has %s\n", cram.Cram_dl_path, local_checksum, irods_checksum)
+		p.failCram(cram, "checksum of download doesn't match iRODS")
+		return
+	}
+	cram.Checksum_verified = true
+	cram.Stage = stage_imeta
+}
+
+// checksumsPath is where the download job of the cram saves the checksums of
+// its download
+func checksumsPath(cram *cram_file) string {
+	return cram.Cram_dl_path + ".checksums"
+}
+
+// readChecksums reads the checksums saved by checksumCommand, one per line
+func readChecksums(path string) ([]string, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(dat)), nil
+}
+
+// checksumCommand implements "irods_downloader checksum", which each download
+// job runs to save the checksums of its download in every format iRODS may
+// hold, so that the pipeline itself never reads a whole cram. The checksums
+// are written to a temporary file first, so that a job killed part way
+// through leaves none rather than a partial one.
+func checksumCommand(args []string) {
+	if len(args) != 2 {
+		log.Fatalln("usage: irods_downloader checksum <file> <output>")
+	}
+	checksums, err := irods.FileChecksums(args[0])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	tmp_path := args[1] + ".tmp"
+	err = ioutil.WriteFile(tmp_path, []byte(strings.Join(checksums, "\n")+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(tmp_path, args[1])
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// verifyCommand implements "irods_downloader verify", recomputing the
+// checksums of every cram downloaded in a project and comparing them with
+// iRODS. It exits with a non-zero status if any don't match.
+func verifyCommand(args []string) {
+	var project_root string
+
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.StringVar(&project_root, "p", ".", "Specify the project root directory")
+	flags.Parse(args)
+
+	checkpoints, err := filepath.Glob(filepath.Join(project_root, "*", "checkpoint.json"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(checkpoints) == 0 {
+		log.Fatalf("No checkpoints found in %s\n", project_root)
+	}
+
+	irods_client := irods.NewIcommandsClient(irods_zone)
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN_LANE\tFILENAME\tIRODS_CHECKSUM\tLOCAL_CHECKSUM\tRESULT")
+	for _, checkpoint := range checkpoints {
+		cram_list, err := readCheckpoint(checkpoint)
+		if err != nil {
+			log.Fatalf("unable to read %s: %s", checkpoint, err.Error())
+		}
+
+		for _, cram := range cram_list {
+			if !cram.Cram_download_success {
+				continue
+			}
+			if stringInSlice(cram.Cram_dl_path, cram.Removed_files) {
+				fmt.Fprintf(w, "%s\t%s\t\t\t%s\n", filepath.Base(filepath.Dir(checkpoint)), cram.Filename, checksum_removed)
+				continue
+			}
+
+			result := checksum_ok
+			local_checksum := ""
+			irods_checksum, err := irods_client.Checksum(cram.Irods_path)
+			if err != nil {
+				log.Println(err)
+				result = checksum_unknown
+			} else if !fileExists(filepath.Join(project_root, cram.Cram_dl_path)) {
+				result = checksum_missing
+			} else {
+				local_checksum, err = irods.FileChecksum(filepath.Join(project_root, cram.Cram_dl_path), irods_checksum)
+				if err != nil {
+					log.Println(err)
+					result = checksum_unknown
+				} else if local_checksum != irods_checksum {
+					result = checksum_mismatch
+				}
+			}
+			if result != checksum_ok {
+				failed++
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				filepath.Base(filepath.Dir(checkpoint)), cram.Filename, irods_checksum, local_checksum, result)
+		}
+	}
+	w.Flush()
+
+	if failed > 0 {
+		log.Fatalf("%d downloads could not be verified\n", failed)
+	}
+}
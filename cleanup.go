@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// cleanupCandidate reports whether the cram's intermediate files are no longer
+// needed, which is once its bam (or the merged bam it is part of) has passed
+// quickcheck and been indexed. Crams of library types that aren't aligned keep
+// their fastqs, as those are their final output.
+func cleanupCandidate(cram *cram_file) bool {
+	return (cram.Stage == stage_done || cram.Stage == stage_merged) &&
+		cram.Realigned_quickcheck_success && cram.Realigned_index_success
+}
+
+// removeIntermediates deletes the downloaded CRAM and/or the fastqs and their
+// symlinks of a cram whose bam is finished, with paths taken relative to
+// project_root. Removed files are recorded in the cram's Removed_files so that
+// they aren't mistaken for missing outputs. It returns whether anything was
+// removed, or is only printed if dry_run is set.
+func removeIntermediates(cram *cram_file, project_root string, crams bool, fastqs bool, dry_run bool) bool {
+	if !cleanupCandidate(cram) {
+		return false
+	}
+
+	var paths []string
+	if crams {
+		paths = append(paths, cram.Cram_dl_path)
+	}
+	if fastqs {
+		for _, link := range fastqLinks(cram) {
+			paths = append(paths, link[1], link[0])
+		}
+	}
+
+	removed := false
+	for _, path := range paths {
+		if path == "" || stringInSlice(path, cram.Removed_files) {
+			continue
+		}
+		if dry_run {
+			fmt.Println(shellQuote([]string{"rm", "-f", filepath.Join(project_root, path)}))
+			continue
+		}
+		err := os.Remove(filepath.Join(project_root, path))
+		if err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+			continue
+		}
+		log.Printf("Removed %s\n", path)
+		cram.Removed_files = append(cram.Removed_files, path)
+		removed = true
+	}
+	return removed
+}
+
+// restoreRemovedInputs sends a cram whose current stage needs files removed
+// by cleanup back to the stage that makes them again: its download for the
+// CRAM, or its fastq extraction for the fastqs. It returns whether the cram
+// was sent back.
+func (p *pipeline) restoreRemovedInputs(cram *cram_file) bool {
+	streams := p.streamsFastqs(cram)
+	if (cram.Stage == stage_fastq && !streams) || (cram.Stage == stage_align && streams) {
+		if !stringInSlice(cram.Cram_dl_path, cram.Removed_files) {
+			return false
+		}
+		log.Printf("Downloading %s again, as it was removed by cleanup\n", cram.Cram_dl_path)
+		cram.Removed_files = removeString(cram.Removed_files, cram.Cram_dl_path)
+		cram.Cram_download_success = false
+		cram.Checksum_verified = false
+		cram.Stage = stage_download
+		return true
+	}
+
+	if cram.Stage == stage_align {
+		removed := false
+		for _, link := range fastqLinks(cram) {
+			for _, path := range link {
+				if stringInSlice(path, cram.Removed_files) {
+					cram.Removed_files = removeString(cram.Removed_files, path)
+					removed = true
+				}
+			}
+		}
+		if !removed {
+			return false
+		}
+		log.Printf("Extracting the fastqs of %s again, as they were removed by cleanup\n", cram.Filename)
+		cram.Fastq_extracted_success = false
+		cram.Stage = stage_fastq
+		return true
+	}
+	return false
+}
+
+// removeString returns the list without any element equal to a
+func removeString(list []string, a string) []string {
+	var kept []string
+	for _, b := range list {
+		if b != a {
+			kept = append(kept, b)
+		}
+	}
+	return kept
+}
+
+// applyRetention removes the intermediate files of finished crams that the
+// config says aren't to be kept, returning whether any were removed
+func (p *pipeline) applyRetention() bool {
+	if p.cfg.Retain_crams && p.cfg.Retain_fastqs {
+		return false
+	}
+	removed := false
+	for _, cram := range cramsOf(p.activeRunLanes()) {
+		if removeIntermediates(cram, ".", !p.cfg.Retain_crams, !p.cfg.Retain_fastqs, false) {
+			removed = true
+		}
+	}
+	return removed
+}
+
+// cleanupCommand implements "irods_downloader cleanup", removing the
+// downloaded CRAMs and fastqs of every finished cram in a project.
+func cleanupCommand(args []string) {
+	var project_root string
+	var keep_crams bool
+	var keep_fastqs bool
+	var dry_run bool
+
+	flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	flags.StringVar(&project_root, "p", ".", "Specify the project root directory")
+	flags.BoolVar(&keep_crams, "keep-crams", false, "Keep the downloaded CRAMs")
+	flags.BoolVar(&keep_fastqs, "keep-fastqs", false, "Keep the extracted fastqs")
+	flags.BoolVar(&dry_run, "dry-run", false, "Print the files that would be removed without removing them")
+	flags.Parse(args)
+
+	// the checkpoints are rewritten, so cleanup can't run while a pipeline is
+	// using them
+	if !dry_run {
+		if err := lockProject(project_root); err != nil {
+			log.Fatalln(err)
+		}
+		defer unlockProject(project_root)
+	}
+
+	checkpoints, err := filepath.Glob(filepath.Join(project_root, "*", "checkpoint.json"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(checkpoints) == 0 {
+		log.Fatalf("No checkpoints found in %s\n", project_root)
+	}
+
+	for _, checkpoint := range checkpoints {
+		cram_list, err := readCheckpoint(checkpoint)
+		if err != nil {
+			log.Fatalf("unable to read %s: %s", checkpoint, err.Error())
+		}
+
+		removed := false
+		for i := range cram_list {
+			if removeIntermediates(&cram_list[i], project_root, !keep_crams, !keep_fastqs, dry_run) {
+				removed = true
+			}
+		}
+		if removed {
+			writeCheckpoint(checkpoint, cram_list)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreRemovedInputs(t *testing.T) {
+	p := &pipeline{cfg: pipeline_config{
+		Aligners:         map[string]*aligner_profile{"star": {Name: "star", Rna: true}},
+		Library_aligners: map[string]string{"rna": "star"},
+	}}
+	removed := func(stage string) *cram_file {
+		return &cram_file{
+			Filename:                "1234_1#1.cram",
+			Stage:                   stage,
+			Library_type:            "RNA",
+			Cram_dl_path:            "1234_1/A_iRODS_CRAM_Downloads/1234_1#1.cram",
+			Cram_download_success:   true,
+			Fastq_1_path:            "1234_1/B_Fastq_Extraction/1234_1#1_1.fq.gz",
+			Symlinked_fq_1:          "1234_1/C_Fastq_Symlinks/s1_1.fq.gz",
+			Fastq_extracted_success: true,
+			Removed_files: []string{
+				"1234_1/A_iRODS_CRAM_Downloads/1234_1#1.cram",
+				"1234_1/C_Fastq_Symlinks/s1_1.fq.gz",
+				"1234_1/B_Fastq_Extraction/1234_1#1_1.fq.gz",
+			},
+		}
+	}
+
+	cram := removed(stage_align)
+	if !p.restoreRemovedInputs(cram) || cram.Stage != stage_fastq || cram.Fastq_extracted_success {
+		t.Errorf("cram aligning from removed fastqs was sent to stage %s, want %s", cram.Stage, stage_fastq)
+	}
+	if len(cram.Removed_files) != 1 {
+		t.Errorf("fastqs being extracted again are still recorded as removed: %v", cram.Removed_files)
+	}
+	if !p.restoreRemovedInputs(cram) || cram.Stage != stage_download || cram.Cram_download_success || len(cram.Removed_files) != 0 {
+		t.Errorf("cram extracting fastqs from a removed CRAM was sent to stage %s, want %s", cram.Stage, stage_download)
+	}
+
+	p.cfg.Stream_fastqs = true
+	cram = removed(stage_align)
+	if !p.restoreRemovedInputs(cram) || cram.Stage != stage_download {
+		t.Errorf("cram streaming from a removed CRAM was sent to stage %s, want %s", cram.Stage, stage_download)
+	}
+
+	cram = removed(stage_qc)
+	if p.restoreRemovedInputs(cram) || cram.Stage != stage_qc {
+		t.Errorf("cram collecting QC metrics was sent back to stage %s", cram.Stage)
+	}
+}
+
+func TestLockProject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := lockProject(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := lockProject(dir); err == nil {
+		t.Errorf("the lock of a project was taken twice")
+	}
+	unlockProject(dir)
+	if err := lockProject(dir); err != nil {
+		t.Errorf("unable to take the lock once released: %s", err)
+	}
+
+	// a lock left behind by a process that has exited is taken over
+	hostname, _ := os.Hostname()
+	lock_path := filepath.Join(dir, lock_filename)
+	err = ioutil.WriteFile(lock_path, []byte(fmt.Sprintf("%s %d\n", hostname, exitedPid(t))), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lockProject(dir); err != nil {
+		t.Errorf("unable to take over a lock left behind: %s", err)
+	}
+
+	// while one from another host can't be checked
+	err = ioutil.WriteFile(lock_path, []byte("elsewhere 1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lockProject(dir); err == nil {
+		t.Errorf("took over the lock of a process on another host")
+	}
+}
+
+// exitedPid returns the pid of a process that has finished
+func exitedPid(t *testing.T) int {
+	process, err := os.StartProcess("/bin/true", []string{"true"}, &os.ProcAttr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	process.Wait()
+	return process.Pid
+}
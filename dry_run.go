@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+)
+
+// dryRun prints the commands every stage would run for each cram, stage by
+// stage, without creating directories, submitting jobs or writing checkpoints.
+// The crams are only updated in memory, as though every stage succeeded, so
+// that the paths used by later stages are filled in. Reading each cram's
+// metadata from iRODS is the only step that is actually run, as the stages
+// that follow depend on its library type and sample name.
+func (p *pipeline) dryRun() {
+	crams := cramsOf(p.activeRunLanes())
+	for _, stage := range cram_stages {
+		fmt.Printf("# Stage %s\n", stage)
+		for _, cram := range crams {
+			if cram.Stage == stage {
+				p.dryRunStage(cram)
+			}
+		}
+		fmt.Println()
+	}
+
+	p.syncMergedCrams()
+	rna_bams := p.rnaBams(crams)
+	fmt.Println("# Stage featurecounts")
+	if p.countsAreCurrent("checkpoint_counts.json", rna_bams) {
+		fmt.Println("# counts matrix is up to date")
+	} else if len(rna_bams) < 1 {
+		fmt.Println("# no RNA bams to count")
+	} else {
+		p.printSubmission(p.featureCountsJob(crams, rna_bams))
+	}
+
+	if p.cfg.Upload_collection != "" && len(rna_bams) > 0 {
+		fmt.Println()
+		fmt.Println("# Stage counts upload")
+		if p.countsAreCurrent("checkpoint_counts_upload.json", rna_bams) {
+			fmt.Println("# counts matrix is already uploaded")
+		} else {
+			p.printSubmission(p.countsUploadJob(crams, rna_bams))
+		}
+	}
+}
+
+// dryRunStage prints the commands of the cram's current stage and moves it on
+// to the next stage.
+func (p *pipeline) dryRunStage(cram *cram_file) {
+	switch cram.Stage {
+	case stage_download:
+		p.printJob(cram, p.downloadJob)
+		cram.Cram_download_success = true
+		cram.Stage = stage_checksum
+
+	case stage_checksum:
+		fmt.Printf("# compare the iRODS checksum of %s with the checksum of %s\n", cram.Irods_path, cram.Cram_dl_path)
+		cram.Checksum_verified = true
+		cram.Stage = stage_imeta
+
+	case stage_imeta:
+		fmt.Printf("# list the metadata of %s\n", cram.Irods_path)
+		avus, err := p.irods.Metadata(cram.Irods_path)
+		if err != nil {
+			log.Println(err)
+			p.failCram(cram, "unable to download imeta")
+			return
+		}
+		cram.Imeta_downloaded = true
+		cram.Metadata = avus
+		p.parseImeta(cram)
+		if _, ok := cram.attribute(p.cfg.Paired_attribute); ok {
+			p.detectPairing(cram)
+		} else {
+			fmt.Printf("# read the flags of the first read of %s to tell whether it is paired, assuming it is\n", cram.Cram_dl_path)
+		}
+		p.checkSample(cram)
+
+	case stage_fastq:
+		if p.streamsFastqs(cram) {
+			fmt.Printf("# reads of %s are streamed into its alignment job\n", cram.Cram_dl_path)
+			cram.Stage = stage_align
+			return
+		}
+		p.printJob(cram, p.fastqJob)
+		cram.Fastq_extracted_success = true
+		p.setSymlinkPaths(cram)
+		for _, link := range fastqLinks(cram) {
+			relative_target, err := filepath.Rel(filepath.Dir(link[1]), link[0])
+			if err != nil {
+				relative_target = link[0]
+			}
+			fmt.Println(shellQuote([]string{"ln", "-sf", relative_target, link[1]}))
+		}
+		cram.Stage = stage_align
+
+	case stage_align:
+		if p.alignerProfile(cram.Library_type) == nil {
+			cram.Stage = stage_done
+			return
+		}
+		if p.cfg.Merge_samples_across_lanes {
+			members, _, ready := p.mergeGroup(cram)
+			if !ready {
+				members = []*cram_file{cram}
+			}
+			for _, member := range members[1:] {
+				member.Merged_into = cram.Filename
+				member.Stage = stage_merged
+			}
+			p.printJob(cram, func(primary *cram_file) job_spec {
+				return p.mergedAlignJob(primary, members)
+			})
+		} else {
+			p.printJob(cram, p.alignJob)
+		}
+		cram.Realigned_succesful = true
+		cram.Stage = stage_quickcheck
+
+	case stage_quickcheck:
+		p.printJob(cram, p.quickcheckJob)
+		cram.Realigned_quickcheck_success = true
+		cram.Stage = stage_index
+
+	case stage_index:
+		p.printJob(cram, p.indexJob)
+		cram.Realigned_index_success = true
+		cram.Stage = stage_qc
+
+	case stage_qc:
+		p.printJob(cram, p.qcJob)
+		cram.Qc_metrics_collected = true
+		cram.Stage = p.stageAfterQc(cram)
+
+	case stage_upload:
+		p.printJob(cram, p.uploadJob)
+		cram.Uploaded = true
+		cram.Stage = stage_done
+	}
+}
+
+// printJob prints the command line that would submit the job built for the
+// cram's current stage, preceded by the script it runs if it has one.
+func (p *pipeline) printJob(cram *cram_file, build_job func(cram *cram_file) job_spec) {
+	job := build_job(cram)
+	p.prepareAttempt(cram, &job)
+	p.printSubmission(job)
+}
+
+// printSubmission prints the command line that would submit the job, preceded
+// by the script it runs if it has one.
+func (p *pipeline) printSubmission(job job_spec) {
+	if job.Script != "" {
+		fmt.Printf("cat > %s <<'EOF'\n%sEOF\n", shellQuote([]string{job.Script_path}), job.Script)
+	}
+	fmt.Println(shellQuote(p.sched.SubmitCommand(job)))
+}
@@ -4,5 +4,5 @@ go 1.12
 
 require (
 	github.com/google/btree v1.0.0 // indirect
-	github.com/spf13/viper v1.9.0 // indirect
+	github.com/spf13/viper v1.9.0
 )
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// what is done with submitted jobs when irods_downloader is interrupted
+const (
+	interrupt_detach = "detach"
+	interrupt_cancel = "cancel"
+)
+
+// parseInterruptAction reads the on_interrupt setting
+func parseInterruptAction(action string) (string, error) {
+	action = strings.ToLower(strings.TrimSpace(action))
+	if action != interrupt_detach && action != interrupt_cancel {
+		return "", fmt.Errorf("unknown on_interrupt '%s', expected one of detach or cancel", action)
+	}
+	return action, nil
+}
+
+// catchInterrupts stops SIGINT and SIGTERM from killing irods_downloader
+// straight away, passing the first to the pipeline so that it can stop
+// between checks on its jobs. A second signal exits immediately, for when the
+// pipeline is stuck in a stage that doesn't check for interrupts.
+func (p *pipeline) catchInterrupts() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	p.interrupts = make(chan os.Signal, 1)
+
+	go func() {
+		p.interrupts <- <-signals
+		sig := <-signals
+		log.Printf("Received %s again, exiting without saving checkpoints\n", sig)
+		os.Exit(exitStatusOf(sig))
+	}()
+}
+
+// exitStatusOf returns the exit status a shell gives a process killed by the
+// signal
+func exitStatusOf(sig os.Signal) int {
+	if signum, ok := sig.(syscall.Signal); ok {
+		return 128 + int(signum)
+	}
+	return 1
+}
+
+// sleep waits for the duration, returning early with the signal if
+// irods_downloader is interrupted in the meantime. It returns nil otherwise.
+func (p *pipeline) sleep(duration time.Duration) os.Signal {
+	select {
+	case sig := <-p.interrupts:
+		return sig
+	case <-time.After(duration):
+		return nil
+	}
+}
+
+// interrupt stops the pipeline after it received the signal. The crams' jobs
+// are either cancelled, or left running for the next run to reattach to, as
+// set by on_interrupt. Jobs of a scheduler that can't be reattached to are
+// always cancelled. The checkpoints are then saved before exiting.
+func (p *pipeline) interrupt(sig os.Signal) {
+	log.Printf("Received %s, stopping\n", sig)
+
+	running := 0
+	for _, cram := range cramsOf(p.activeRunLanes()) {
+		if cram.Job_id == "" {
+			continue
+		}
+		if p.cfg.On_interrupt == interrupt_detach && p.sched.Detachable() {
+			running++
+			continue
+		}
+		p.cancelJob(cram)
+	}
+	if running > 0 {
+		log.Printf("Leaving %d jobs running, which will be picked up by the next run\n", running)
+	}
+
+	p.writeCheckpoints()
+	log.Println("Checkpoints saved")
+	unlockProject(".")
+	os.Exit(exitStatusOf(sig))
+}
+
+// cancelJob cancels the cram's current job, recording its attempt as
+// cancelled so that it isn't counted as a failure when the stage is run again
+func (p *pipeline) cancelJob(cram *cram_file) {
+	log.Printf("Cancelling job %s of %s\n", cram.Job_id, cram.Filename)
+	if err := p.sched.Cancel(cram.Job_id); err != nil {
+		log.Println(err)
+	}
+	for i := range cram.Job_attempts {
+		attempt := &cram.Job_attempts[i]
+		if attempt.Job_id == cram.Job_id && attempt.Stage == cram.Stage && !attempt.Finished {
+			attempt.Finished = true
+			attempt.Ended = time.Now()
+			attempt.Exit_status = -1
+			attempt.Cancelled = true
+		}
+	}
+	cram.Job_id = ""
+}
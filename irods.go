@@ -0,0 +1,4 @@
+package main
+
+// the iRODS zone sequencing data is kept in
+const irods_zone = "seq"
@@ -0,0 +1,77 @@
+package irods
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// checksumHash returns the hash that computes checksums in the same format as
+// the given iRODS checksum. iRODS holds an md5 in hex, or a sha256 in base64
+// prefixed with "sha2:" on zones configured to use sha256.
+func checksumHash(irods_checksum string) hash.Hash {
+	if strings.HasPrefix(irods_checksum, "sha2:") {
+		return sha256.New()
+	}
+	return md5.New()
+}
+
+// formatChecksum formats the sum of a hash returned by checksumHash as iRODS
+// would
+func formatChecksum(irods_checksum string, sum []byte) string {
+	if strings.HasPrefix(irods_checksum, "sha2:") {
+		return "sha2:" + base64.StdEncoding.EncodeToString(sum)
+	}
+	return hex.EncodeToString(sum)
+}
+
+// FileChecksums computes the checksum of a local file in each of the formats
+// iRODS may hold, reading the file only once
+func FileChecksums(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	md5_hash, sha2_hash := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5_hash, sha2_hash), file); err != nil {
+		return nil, err
+	}
+	return []string{
+		formatChecksum("", md5_hash.Sum(nil)),
+		formatChecksum("sha2:", sha2_hash.Sum(nil)),
+	}, nil
+}
+
+// MatchingChecksum returns the one of the checksums in the same format as
+// the given iRODS checksum
+func MatchingChecksum(checksums []string, irods_checksum string) (string, bool) {
+	for _, checksum := range checksums {
+		if strings.HasPrefix(checksum, "sha2:") == strings.HasPrefix(irods_checksum, "sha2:") {
+			return checksum, true
+		}
+	}
+	return "", false
+}
+
+// FileChecksum computes the checksum of a local file in the same format as
+// the given iRODS checksum, so that the two can be compared directly.
+func FileChecksum(path string, irods_checksum string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := checksumHash(irods_checksum)
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return formatChecksum(irods_checksum, h.Sum(nil)), nil
+}
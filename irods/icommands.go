@@ -0,0 +1,191 @@
+package irods
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// icommands_client accesses iRODS through the icommands (imeta, ils, ichksum
+// and iget, and iput and imkdir for uploads), which must be on the PATH and
+// authenticated with iinit.
+type icommands_client struct {
+	zone string
+}
+
+// NewIcommandsClient returns a client that runs the icommands, querying the
+// zone
+func NewIcommandsClient(zone string) Client {
+	return &icommands_client{zone: zone}
+}
+
+// run runs an icommand, returning its stdout or an error that includes
+// whatever it printed
+func (c *icommands_client) run(name string, args ...string) (string, error) {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %s: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// parseRecords splits the output of imeta into its records, which are
+// separated by "----" lines and made up of "key: value" lines. Lines that
+// aren't in that form, such as imeta's "AVUs defined for ..." header, are
+// skipped.
+func parseRecords(output string) []map[string]string {
+	var records []map[string]string
+	record := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "----" {
+			if len(record) > 0 {
+				records = append(records, record)
+			}
+			record = make(map[string]string)
+			continue
+		}
+		split_line := strings.SplitN(line, ":", 2)
+		if len(split_line) != 2 || strings.Contains(split_line[0], " ") {
+			continue
+		}
+		record[split_line[0]] = strings.TrimSpace(split_line[1])
+	}
+	if len(record) > 0 {
+		records = append(records, record)
+	}
+	return records
+}
+
+// Query finds the data objects matching every condition with "imeta qu"
+func (c *icommands_client) Query(conditions []Condition) ([]Data_object, error) {
+	args := []string{"qu", "-z", c.zone, "-d"}
+	for i, condition := range conditions {
+		if i > 0 {
+			args = append(args, "and")
+		}
+		args = append(args, condition.Attribute, condition.Operator, condition.Value)
+	}
+
+	output, err := c.run("imeta", args...)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(output) == "No rows found" {
+		return nil, nil
+	}
+
+	var objects []Data_object
+	for _, record := range parseRecords(output) {
+		collection, has_collection := record["collection"]
+		name, has_name := record["dataObj"]
+		if !has_collection || !has_name || collection == "" || name == "" {
+			return nil, fmt.Errorf("collection or dataObj missing from imeta record: %v", record)
+		}
+		objects = append(objects, Data_object{Collection: collection, Name: name})
+	}
+	return objects, nil
+}
+
+// CheckAuth checks the icommands the client runs itself are on the PATH, and
+// that ils can list the user's home collection, which fails if iinit hasn't
+// been run or the password it saved has expired. The icommands run by jobs
+// are checked along with the commands of the rest of their job.
+func (c *icommands_client) CheckAuth() error {
+	for _, name := range []string{"imeta", "ils", "ichksum"} {
+		if _, err := exec.LookPath(name); err != nil {
+			return err
+		}
+	}
+	_, err := c.run("ils")
+	return err
+}
+
+// Exists checks the data object exists with ils
+func (c *icommands_client) Exists(irods_path string) (bool, error) {
+	output, err := exec.Command("ils", irods_path).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(output), "does not exist") {
+			return false, nil
+		}
+		return false, fmt.Errorf("ils failed: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return true, nil
+}
+
+// Metadata lists the AVUs of the data object with "imeta ls"
+func (c *icommands_client) Metadata(irods_path string) ([]Avu, error) {
+	output, err := c.run("imeta", "ls", "-d", irods_path)
+	if err != nil {
+		return nil, err
+	}
+
+	var avus []Avu
+	for _, record := range parseRecords(output) {
+		attribute, ok := record["attribute"]
+		if !ok {
+			continue
+		}
+		avus = append(avus, Avu{
+			Attribute: attribute,
+			Value:     record["value"],
+			Units:     record["units"],
+		})
+	}
+	return avus, nil
+}
+
+// Checksum returns the checksum iRODS holds for the data object, as printed by
+// ichksum. This is an md5 in hex, or a sha256 in base64 prefixed with "sha2:"
+// on zones configured to use sha256.
+func (c *icommands_client) Checksum(irods_path string) (string, error) {
+	output, err := c.run("ichksum", irods_path)
+	if err != nil {
+		return "", err
+	}
+
+	// ichksum prints the name of the data object followed by its checksum
+	name := path.Base(irods_path)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == name {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("unable to find checksum in ichksum output: %s", strings.TrimSpace(output))
+}
+
+// DownloadCommand returns the iget command that downloads the data object,
+// verifying the transfer against its checksum and overwriting any partial
+// download left by a previous attempt
+func (c *icommands_client) DownloadCommand(irods_path string, local_path string) []string {
+	return []string{"iget", "-f", "-K", irods_path, local_path}
+}
+
+// UploadCommand returns the iput command that uploads a local file, verifying
+// the transfer against its checksum and overwriting any copy left by a
+// previous attempt
+func (c *icommands_client) UploadCommand(local_path string, irods_path string) []string {
+	return []string{"iput", "-f", "-K", local_path, irods_path}
+}
+
+// MkdirCommand returns the imkdir command that creates the collection and any
+// of its parents that don't exist
+func (c *icommands_client) MkdirCommand(collection string) []string {
+	return []string{"imkdir", "-p", collection}
+}
+
+// MetadataCommands returns the imeta commands that give the data object the
+// AVUs, setting the first value of each attribute and adding the rest
+func (c *icommands_client) MetadataCommands(irods_path string, avus []Avu) [][]string {
+	var cmds [][]string
+	for i, verb := range metadataVerbs(avus) {
+		cmd := []string{"imeta", verb, "-d", irods_path, avus[i].Attribute, avus[i].Value}
+		if avus[i].Units != "" {
+			cmd = append(cmd, avus[i].Units)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds
+}
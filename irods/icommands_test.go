@@ -0,0 +1,38 @@
+package irods
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRecords(t *testing.T) {
+	tests := []struct {
+		output string
+		want   []map[string]string
+	}{
+		{"", nil},
+		{"No rows found\n", nil},
+		{
+			"collection: /seq/1234\ndataObj: 1234_1#1.cram\n----\ncollection: /seq/1234\ndataObj: 1234_1#2.cram\n",
+			[]map[string]string{
+				{"collection": "/seq/1234", "dataObj": "1234_1#1.cram"},
+				{"collection": "/seq/1234", "dataObj": "1234_1#2.cram"},
+			},
+		},
+		{
+			// imeta ls starts with a header, and values may contain colons
+			"AVUs defined for dataObj /seq/1234/1234_1#1.cram:\nattribute: sample\nvalue: a:b\nunits: \n----\n" +
+				"attribute: library_type\nvalue: GnT scRNA\nunits:\n",
+			[]map[string]string{
+				{"attribute": "sample", "value": "a:b", "units": ""},
+				{"attribute": "library_type", "value": "GnT scRNA", "units": ""},
+			},
+		},
+		{"----\n----\nattribute: a\n----\n", []map[string]string{{"attribute": "a"}}},
+	}
+	for _, test := range tests {
+		if got := parseRecords(test.output); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseRecords(%q) = %v, want %v", test.output, got, test.want)
+		}
+	}
+}
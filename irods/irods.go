@@ -0,0 +1,79 @@
+// Package irods accesses iRODS, the data management system sequencing data is
+// kept in, returning typed results rather than the text printed by the
+// icommands. The icommands are run behind Client, so that another way of
+// accessing iRODS can be added without changing the pipeline.
+package irods
+
+import "path"
+
+// Data_object is a file held in iRODS
+type Data_object struct {
+	Collection string
+	Name       string
+}
+
+func (o Data_object) Path() string {
+	return path.Join(o.Collection, o.Name)
+}
+
+// Avu is a single attribute, value and units triple of metadata attached to a
+// data object
+type Avu struct {
+	Attribute string
+	Value     string
+	Units     string
+}
+
+// Condition restricts a metadata query to data objects whose attribute
+// compares to the value with the operator, e.g. "id_run" "=" "1234"
+type Condition struct {
+	Attribute string
+	Operator  string
+	Value     string
+}
+
+// Client is implemented by each of the ways iRODS can be accessed, so that
+// the pipeline works with typed results rather than the output of the command
+// line tools. Data objects are downloaded and uploaded inside scheduler jobs,
+// so the *Command methods return the commands a job runs rather than
+// transferring anything themselves. CheckAuth returns an error if iRODS can't
+// be reached with the user's credentials, so that expired credentials are
+// found before a run starts.
+type Client interface {
+	CheckAuth() error
+	Query(conditions []Condition) ([]Data_object, error)
+	Exists(irods_path string) (bool, error)
+	Metadata(irods_path string) ([]Avu, error)
+	Checksum(irods_path string) (string, error)
+	DownloadCommand(irods_path string, local_path string) []string
+	UploadCommand(local_path string, irods_path string) []string
+	MkdirCommand(collection string) []string
+	MetadataCommands(irods_path string, avus []Avu) [][]string
+}
+
+// AvuValue returns the value of the first of the AVUs with the attribute
+func AvuValue(avus []Avu, attribute string) (string, bool) {
+	for _, avu := range avus {
+		if avu.Attribute == attribute {
+			return avu.Value, true
+		}
+	}
+	return "", false
+}
+
+// metadataVerbs returns whether each of the AVUs is set, replacing any values
+// its attribute already has, or added. The first value of each attribute is
+// set and the rest added, so that applying the AVUs again after a failed
+// attempt doesn't duplicate them.
+func metadataVerbs(avus []Avu) []string {
+	verbs := make([]string, len(avus))
+	set := make(map[string]bool)
+	for i, avu := range avus {
+		verbs[i] = "add"
+		if !set[avu.Attribute] {
+			verbs[i] = "set"
+			set[avu.Attribute] = true
+		}
+	}
+	return verbs
+}
@@ -1,33 +1,37 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"reflect"
+	"runtime"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/seanlaidlaw/iRODS-Downloader/irods"
 	"github.com/spf13/viper"
 )
 
-// PIPELINE STEPS
-// 0. Assess what CRAM files are being requested
-// 1. Download CRAM files
-// 2. Download imeta files for each cram file
-// 3. Establish unique sample names exist
-// 4. Convert the CRAM files to fastq
-// 5. Symlink the fastqs to two different folders depending on 'Library_type'
-// 6. Align extracted fastqs with STAR or BWA depending on 'Library_type'
-// 7. Samtools Quickcheck generated bams
-// 8. Index realigned bam files
-// 8. Generate counts matrix of RNA bams
+// PIPELINE STAGES
+// Once the CRAM files being requested have been assessed, each CRAM moves
+// through the following stages on its own, as soon as its previous stage has
+// completed:
+// download.   Download CRAM file
+// checksum.   Compare the checksum of the download with the one held by iRODS
+// imeta.      Download and parse imeta, establishing its sample name is unique
+// fastq.      Convert the CRAM file to fastq, and symlink the fastqs to
+//             different folders depending on 'Library_type'
+// align.      Align extracted fastqs with STAR or BWA depending on 'Library_type'
+// quickcheck. Samtools Quickcheck generated bam
+// index.      Index realigned bam file
+// qc.         Collect alignment metrics of the bam and flag poor samples
+// upload.     Upload the bam to iRODS, if an upload collection is configured
+// Once every CRAM has finished or failed, a counts matrix of RNA bams is
+// generated.
 
 // fileExists checks if a file exists and is not a directory before we
 // try using it to prevent further errors.
@@ -47,824 +51,454 @@ func stringInSlice(a string, list []string) bool {
 	return false
 }
 
-func writeCheckpoint(cram_list []cram_file, step int) {
-	checkpoint_file := fmt.Sprintf("checkpoint_%d.json", step)
+// readCheckpoint loads the crams saved in a checkpoint file
+func readCheckpoint(checkpoint_file string) ([]cram_file, error) {
+	var cram_list []cram_file
+	byteValue, err := ioutil.ReadFile(checkpoint_file)
+	if err == nil {
+		err = json.Unmarshal(byteValue, &cram_list)
+	}
+	return cram_list, err
+}
+
+// writeCheckpoint saves cram_list as JSON, writing to a temporary file first so
+// that a checkpoint is never left half written if we are interrupted.
+func writeCheckpoint(checkpoint_file string, cram_list []cram_file) {
 	rankingsJson, _ := json.MarshalIndent(cram_list, "", "  ")
-	err := ioutil.WriteFile(checkpoint_file, rankingsJson, 0644)
+	err := ioutil.WriteFile(checkpoint_file+".tmp", rankingsJson, 0644)
+	if err == nil {
+		err = os.Rename(checkpoint_file+".tmp", checkpoint_file)
+	}
 	if err != nil {
 		panic(err)
 	}
-	log.Println(fmt.Sprintf("Checkpoint saved for step %d", step))
 }
 
-func bjobsIsCompleted(
-	submitted_jobs_map map[string]string,
-	attribute_name string,
-	cram_list *[]cram_file,
-) {
-	// while there are still jobs in submitted_jobs_map, iterate over reading through all job outputs and only leave when all have completed successfully
-	for len(submitted_jobs_map) > 0 {
-		for i := range *cram_list {
-			func_cram := &((*cram_list)[i])
-			bjobs_output_filename := submitted_jobs_map[func_cram.Filename]
-
-			dat, err := ioutil.ReadFile(bjobs_output_filename)
-			if err == nil {
-				// when job has finished (either successfully or with exit code, remove from the waiting list 'submitted_jobs_map'
-				if strings.Contains(string(dat), "Terminated at") {
-					delete(submitted_jobs_map, func_cram.Filename)
-
-					// if job has finished and successfully completed then set the specified attribute_name to true
-					if strings.Contains(string(dat), "Successfully completed.") {
-						reflect.ValueOf(func_cram).Elem().FieldByName(attribute_name).SetBool(true)
-					} else {
-						log.Println(fmt.Sprintf("Error with bsub job: %s", bjobs_output_filename))
-					}
-				}
-			}
-		}
-		// sleep for 5 seconds after going through every job's output before retrying
-		time.Sleep(5 * time.Second)
+// jobIsCompleted polls the cram's current job, and once the job has finished
+// (either successfully or with exit code) sets the specified attribute_name to
+// true if it completed successfully. It returns the state of the job, and its
+// exit status once it has finished. A job the scheduler has lost has an exit
+// status of -1.
+func jobIsCompleted(sched scheduler, func_cram *cram_file, attribute_name string) (job_state, int) {
+	state, err := sched.Poll(func_cram.Job_id)
+	if err != nil {
+		log.Printf("Unable to poll job %s: %s\n", func_cram.Job_id, err.Error())
+		return job_pending, -1
+	}
+	if state == job_lost {
+		log.Printf("Job %s for %s was lost by the scheduler\n", func_cram.Job_id, func_cram.Filename)
+		// a zombie job may still be known to the scheduler, so make sure it
+		// can't write to the outputs of its retry
+		sched.Cancel(func_cram.Job_id)
+		return job_lost, -1
+	}
+	if state != job_finished {
+		return state, -1
 	}
-}
-
-func quickcheck_alignments(cram_list []cram_file, i int, samtools_exec string) {
-	cram := &cram_list[i]
-
-	bam_filename := cram.Realigned_bam_path
-	output, err := exec.Command(samtools_exec, "quickcheck", bam_filename).CombinedOutput()
 
-	if err != nil {
-		// Display everything we got if error.
-		log.Println("Error when running command.  Output:")
-		log.Println(string(output))
-		log.Printf("Got command status: %s\n", err.Error())
-		cram.Realigned_quickcheck_success = false
+	// if job has finished and successfully completed then set the specified attribute_name to true
+	exit_status, err := sched.ExitStatus(func_cram.Job_id)
+	if err == nil && exit_status == 0 {
+		reflect.ValueOf(func_cram).Elem().FieldByName(attribute_name).SetBool(true)
 	} else {
-		cram.Realigned_quickcheck_success = true
+		log.Println(fmt.Sprintf("Error with job %s for %s", func_cram.Job_id, func_cram.Filename))
 	}
-	wg.Done()
+	return job_finished, exit_status
 }
 
-func indexBam(cram_list []cram_file, i int, samtools_exec string) {
-	cram := &cram_list[i]
-
-	bam_filename := cram.Realigned_bam_path
-	output, err := exec.Command(samtools_exec, "index", bam_filename).CombinedOutput()
-
-	if err != nil {
-		// Display everything we got if error.
-		log.Println("Error when running command.  Output:")
-		log.Println(string(output))
-		log.Printf("Got command status: %s\n", err.Error())
-		cram.Realigned_index_success = false
-	} else {
-		cram.Realigned_index_success = true
-	}
-	wg.Done()
+// attribute returns the first value of the attribute in the cram's iRODS
+// metadata
+func (cram *cram_file) attribute(name string) (string, bool) {
+	return irods.AvuValue(cram.Metadata, name)
 }
 
 type cram_file struct {
 	Filename                     string
+	Stage                        string
+	Failed_stage                 string
+	Job_id                       string
+	Job_attempts                 []job_attempt
+	Retry_after                  time.Time
 	Runid                        string
 	Runlane                      string
+	Run_lane_dir                 string
 	Irods_path                   string
 	File_exists_in_irods         bool
 	Cram_is_phix                 bool
 	Cram_dl_path                 string
 	Cram_download_success        bool
+	Irods_checksum               string
+	Local_checksum               string
+	Checksum_verified            bool
 	Imeta_path                   string
+	Metadata                     []irods.Avu
 	Library_type                 string
 	Sample_name                  string
 	Imeta_downloaded             bool
 	Imeta_parsed                 bool
+	Single_end                   bool
 	Fastq_1_path                 string
 	Fastq_2_path                 string
+	Index_1_path                 string
+	Index_2_path                 string
 	Fastq_extracted_success      bool
 	Symlinked_fq_1               string
 	Symlinked_fq_2               string
+	Symlinked_i1                 string
+	Symlinked_i2                 string
+	Fastqs_streamed              bool
 	Realigned_bam_path           string
+	Realigned_script_path        string
+	Merged_into                  string
+	Merge_missing                []string
 	Realigned_succesful          bool
 	Realigned_quickcheck_success bool
 	Realigned_index_success      bool
+	Aligner_out_prefix           string
+	Qc_metrics_collected         bool
+	Qc_metrics                   *qc_metrics
+	Qc_flags                     []string
+	Upload_irods_path            string
+	Uploaded                     bool
+	Removed_files                []string
 }
 
-var cram_list []cram_file
-
-var wg sync.WaitGroup
+// pipeline_config holds the settings read from irods_downloader_config.yaml
+type pipeline_config struct {
+	Library_type_attribute       string
+	Attribute_with_sample_name   string
+	Required_attributes          []string
+	Read_group_library_attribute string
+	Read_group_platform          string
+	Merge_samples_across_lanes   bool
+	Paired_attribute             string
+	Index_read_libraries         []string
+	Stream_fastqs                bool
+	Upload_collection            string
+	Samtools_exec                string
+	Aligners                     map[string]*aligner_profile
+	Library_aligners             map[string]string
+	Qc_thresholds                map[string]qc_thresholds
+	Multiqc_dir                  string
+	Featurecounts_exec           string
+	Featurecounts_ram            int
+	Genome_annot                 string
+	Job_max_attempts             int
+	Job_retry_backoff            time.Duration
+	Job_memory_escalation        float64
+	Job_timeouts                 map[string]time.Duration
+	On_interrupt                 string
+	Retain_crams                 bool
+	Retain_fastqs                bool
+}
 
 func main() {
-	// we want to load a config file named "irods_downloader_config.yaml" if it exists in WD or in ~/.config
-	viper.SetConfigName("irods_downloader_config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath(".")              // look for config in the working directory first
-	viper.AddConfigPath("$HOME/.config/") // if not found then look in .config folder
-
-	viper.SetDefault("star_align_libraries", []string{"GnT scRNA"})
-	viper.SetDefault("bwa_align_libraries", []string{"GnT Picoplex"})
-
-	viper.SetDefault("attribute_with_sample_name", "sample_supplier_name")
-	viper.SetDefault(
-		"samtools_exec",
-		"/software/CASM/modules/installs/samtools/samtools-1.11/bin/samtools",
-	)
-	viper.SetDefault(
-		"star_exec",
-		"/nfs/users/nfs_r/rr11/Tools/STAR-2.5.2a/bin/Linux_x86_64_static/STAR",
-	)
-	viper.SetDefault("star_ram", "50000")
-	viper.SetDefault(
-		"star_genome_dir",
-		"/lustre/scratch119/casm/team78pipelines/reference/human/GRCh37d5_ERCC92/star/75/",
-	)
-	viper.SetDefault("bwa_exec", "/software/CASM/modules/installs/bwa/bwa-0.7.17/bin/bwa")
-	viper.SetDefault("bwa_ram", "50000")
-	viper.SetDefault(
-		"bwa_genome_ref",
-		"/lustre/scratch119/casm/team78pipelines/reference/human/GRCH37d5/genome.fa",
-	)
-	viper.SetDefault(
-		"featurecounts_exec",
-		"/nfs/users/nfs_s/sl31/Tools/subread-2.0.1-Linux-x86_64/bin/featureCounts",
-	)
-	viper.SetDefault("featurecounts_ram", "20000")
-	viper.SetDefault(
-		"genome_annot",
-		"/nfs/users/nfs_s/sl31/ref/hg19_cDNA_gene_name_featurecounts.gtf",
-	)
-
-	// read in config file if found, else use defaults
-	if err := viper.ReadInConfig(); err != nil {
-		log.Fatalln("Unable to read config file")
+	// subcommands are given as the first argument, otherwise run the pipeline
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		statusCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verifyCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		checkCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		reportCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cleanup" {
+		cleanupCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "checksum" {
+		checksumCommand(os.Args[2:])
+		return
 	}
 
-	// Config file found and successfully parsed
-	star_align_libraries := viper.GetStringSlice("star_align_libraries")
-	bwa_align_libraries := viper.GetStringSlice("bwa_align_libraries")
-
-	attribute_with_sample_name := viper.GetString("attribute_with_sample_name")
-	samtools_exec := viper.GetString("samtools_exec")
-	star_exec := viper.GetString("star_exec")
-	star_ram := viper.GetString("star_ram")
-	star_genome_dir := viper.GetString("star_genome_dir")
-	bwa_exec := viper.GetString("bwa_exec")
-	bwa_ram := viper.GetString("bwa_ram")
-	bwa_genome_ref := viper.GetString("bwa_genome_ref")
-	featurecounts_exec := viper.GetString("featurecounts_exec")
-	featurecounts_ram := viper.GetString("featurecounts_ram")
-	genome_annot := viper.GetString("genome_annot")
-
-	var run string
-	var lane string
-	var current_step int
+	var runs string_list_flag
+	var lanes string_list_flag
+	var manifest string
+	var project_root string
+	var dry_run bool
+	var skip_check bool
+	var studies string_list_flag
+	var sample_file string
+	var where string_list_flag
 
 	// flags declaration using flag package
-	flag.StringVar(&run, "r", "run", "Specify sequencing run")
-	flag.StringVar(&lane, "l", "lane", "Specify sequencing lane")
+	flag.Var(&runs, "r", "Specify sequencing run, can be repeated to give one run per lane")
+	flag.Var(&lanes, "l", "Specify sequencing lane, ranges such as 1-8 are accepted, can be repeated")
+	flag.StringVar(&manifest, "m", "", "Specify a file of run and lane pairs, one pair per line")
+	flag.StringVar(&project_root, "p", ".", "Specify the project root directory outputs are written to")
+	flag.Var(&studies, "study", "Select the crams of an iRODS study_id, can be repeated")
+	flag.StringVar(&sample_file, "sample-file", "", "Select the crams of the samples listed in a file, one per line")
+	flag.Var(&where, "where", "Select crams with the iRODS metadata attribute=value, can be repeated")
+	flag.BoolVar(&dry_run, "dry-run", false, "Print the commands that would be run without running them")
+	flag.BoolVar(&skip_check, "skip-check", false, "Don't check the config, executables and iRODS authentication first")
 
 	flag.Parse() // after declaring flags we need to call it
-	if (strings.TrimSpace(run) == "run") || (strings.TrimSpace(lane) == "lane") {
-		log.Fatalln("No lane or run argument was provided")
-	}
-
-	current_step = 0
-	// if iRODS has already been polled and list of objects to download has been assesed
-	// then load session information and continue
-	if fileExists(fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &cram_list)
-		if err != nil {
-			panic(err)
-		}
-
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
-
-	} else {
-		log.Println(fmt.Sprintf("Starting step %d", current_step))
-
-		log.Println(fmt.Sprintf("Polling iRODS for crams associated with run: %s, and lane: %s", run, lane))
-		output, err := exec.Command(
-			"imeta", "qu", "-z", "seq", "-d",
-			"id_run", "=", run, "and", "lane", "=", lane,
-			"and", "type", "=", "cram").CombinedOutput()
 
+	var run_lanes []*run_lane
+	if manifest != "" {
+		manifest_run_lanes, err := readManifest(manifest)
 		if err != nil {
-			// Display everything we got if error.
-			log.Println("Error when running command.  Output:")
-			log.Println(string(output))
-			log.Printf("Got command status: %s\n", err.Error())
-			return
-		}
-
-		if strings.TrimSpace(string(output)) == "No rows found" {
-			log.Fatalln("No iRODS data retrieved with given lane and run")
-		}
-
-		var collection, filename string
-		split_output := bytes.Split(output, []byte("----"))
-
-		// for each cram file returned by iRODS, parse into its own object and write its run, lane,
-		// and iRODS path as object metadata. Add each of these objects to the cram_list array
-		log.Println("Parsing iRODS output to generate list of crams")
-		for _, line := range split_output {
-			collection = ""
-			filename = ""
-			for _, l := range strings.Split(strings.TrimSuffix(string(line), "\n"), "\n") {
-				if strings.HasPrefix(l, "collection:") {
-					collection = strings.TrimSpace(strings.ReplaceAll(l, "collection:", ""))
-					if !strings.HasPrefix(collection, "/seq/") {
-						log.Fatalf("Revieved unexpected collection '%s' for file '%s'", collection, line)
-					}
-				}
-
-				if strings.HasPrefix(l, "dataObj:") {
-					filename = strings.TrimSpace(strings.ReplaceAll(l, "dataObj:", ""))
-					if !strings.HasSuffix(filename, ".cram") {
-						log.Fatalf("Revieved unexpected filename '%s' when expecting cram", line)
-					}
-				}
-			}
-
-			if filename == "" || collection == "" {
-				log.Fatalf("Filename or collection was empty for line: %s", line)
-			}
-
-			filename = strings.ReplaceAll(filename, ":", "")
-			split_filename := strings.Split(filename, "_")
-			phix_status := false
-			if stringInSlice("phix.cram", split_filename) {
-				phix_status = true
-			}
-			if strings.HasSuffix(filename, "#0.cram") {
-				phix_status = true
-			}
-			run_lane := strings.Split(split_filename[1], "#")[0] // this gets between _ and # which is lane
-			run_lane = strings.TrimSpace(run_lane)
-
-			cram_list = append(cram_list, cram_file{
-				Filename:     filename,
-				Runid:        strings.Split(collection, "/seq/")[1],
-				Runlane:      run_lane,
-				Irods_path:   strings.TrimSpace(collection + "/" + filename),
-				Cram_is_phix: phix_status,
-			})
+			log.Fatalln(err)
 		}
-
-		cram_list_len := len(cram_list)
-		if cram_list_len < 1 {
-			log.Fatalln("There are less than 1 items in run's cram list")
-		}
-
-		cram_exists_map := make(map[string]string)
-		// for each cram in iRODS check it exists with the "ils" command and write result to object metadata
-		log.Println("Verifying each iRODS cram file exists")
-		for i := range cram_list {
-			cram := &cram_list[i]
-			if cram.Cram_is_phix == false {
-				output, err := exec.Command("ils", cram.Irods_path).CombinedOutput()
-				if err == nil {
-					cram.File_exists_in_irods = true
-					cram_exists_map[cram.Filename] = cram.Irods_path
-				} else if err != nil {
-					// Display everything we got if error.
-					log.Println("Error when running command.  Output:")
-					log.Println(string(output))
-					log.Printf("Got command status: %s\n", err.Error())
-					return
-				}
-			}
-		}
-
-		if len(cram_exists_map) < 1 {
-			log.Fatalln("There are no crams in cram exists list")
-		}
-
-		// write copy of array of cram objects to JSON file
-		writeCheckpoint(cram_list, current_step)
+		run_lanes = append(run_lanes, manifest_run_lanes...)
 	}
-
-	current_step = 1
-	// if CRAMS downloaded then load session information and continue
-	if fileExists(fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &cram_list)
-		if err != nil {
-			panic(err)
-		}
-
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
-
-	} else {
-		log.Println(fmt.Sprintf("Starting step %d", current_step))
-
-		// download each of the cram files
-		log.Println("Starting download of iRODS CRAM files")
-		cram_dl_dir := "A_iRODS_CRAM_Downloads/"
-		err := os.Mkdir(cram_dl_dir, 0755)
+	if len(runs) > 0 || len(lanes) > 0 {
+		flag_run_lanes, err := runLanesFromFlags(runs, lanes)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalln(err)
 		}
-
-		undownloaded_cram_map := make(map[string]string)
-		for i := range cram_list {
-			cram := &cram_list[i]
-			if cram.File_exists_in_irods {
-				undownloaded_cram_map[cram.Filename] = cram_dl_dir + "/" + cram.Filename + ".o"
-				cram.Cram_dl_path = cram_dl_dir + "/" + cram.Filename
-				output, err := exec.Command(
-					"bsub",
-					"-o", cram_dl_dir+"/"+cram.Filename+".o",
-					"-e", cram_dl_dir+"/"+cram.Filename+".e",
-					"-R'select[mem>2000] rusage[mem=2000]'", "-M2000",
-					"iget", "-K", cram.Irods_path, cram.Cram_dl_path).CombinedOutput()
-
-				if err != nil {
-					// Display everything we got if error.
-					log.Println("Error when running command.  Output:")
-					log.Println(string(output))
-					log.Printf("Got command status: %s\n", err.Error())
-					return
-				}
-			}
-		}
-
-		if len(undownloaded_cram_map) < 1 {
-			log.Fatalln("There are less than 1 items in cram download list")
-		}
-
-		// verify the cram files downloaded correctly and write download status to object metadata
-		log.Println("Waiting for CRAM downloads to finish")
-		// this updates in place the specified attribute for objects in cram_list for the
-		// jobs that have finished successfully
-		bjobsIsCompleted(undownloaded_cram_map, "Cram_download_success", &cram_list)
-
-		writeCheckpoint(cram_list, current_step)
+		run_lanes = append(run_lanes, flag_run_lanes...)
 	}
+	run_lanes = uniqueRunLanes(run_lanes)
 
-	current_step = 2
-	// if imeta already downloaded then load session information and continue
-	if fileExists(fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &cram_list)
+	sel := &selection{studies: studies}
+	if sample_file != "" {
+		samples, err := readSampleFile(sample_file)
 		if err != nil {
-			panic(err)
+			log.Fatalln(err)
 		}
-
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
-
-	} else {
-		log.Println(fmt.Sprintf("Starting step %d", current_step))
-
-		log.Println("Getting imeta for each downloaded cram")
-		for i := range cram_list {
-			cram := &cram_list[i]
-			if cram.Cram_download_success {
-
-				cmd := exec.Command("imeta", "ls", "-d", cram.Irods_path)
-
-				cram.Imeta_path = cram.Cram_dl_path + ".imeta"
-				imeta_file, err := os.Create(cram.Imeta_path)
-				if err != nil {
-					log.Fatal(err)
-				}
-				defer imeta_file.Close()
-
-				// Send stdout to the outfile. cmd.Stdout will take any io.Writer.
-				cmd.Stdout = imeta_file
-				err = cmd.Run()
-				if err != nil {
-					// Display everything we got if error.
-					log.Println("Error when running command.  Output:")
-					log.Printf("Got command status: %s\n", err.Error())
-					return
-				}
-				cram.Imeta_downloaded = true
-			}
-		}
-
-		writeCheckpoint(cram_list, current_step)
+		sel.samples = samples
 	}
-
-	current_step = 3
-	// if unique sample names already established
-	if fileExists(fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &cram_list)
-		if err != nil {
-			panic(err)
-		}
-
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
-
-	} else {
-
-		log.Println("Parsing imeta file to obtain library_type and sample name")
-		for i := range cram_list {
-			cram := &cram_list[i]
-			if cram.Imeta_downloaded {
-
-				library_type := ""
-				sample_name := ""
-
-				imeta, _ := ioutil.ReadFile(cram.Imeta_path)
-				split_imeta := bytes.Split(imeta, []byte("----"))
-				for _, line := range split_imeta {
-					if bytes.Contains(line, []byte("attribute: library_type")) {
-						line_split := strings.Split(strings.TrimSuffix(string(line), "\n"), "\n")
-						for _, l := range line_split {
-							if strings.Contains(l, "value:") {
-								library_type = strings.ReplaceAll(l, "value:", "")
-								library_type = strings.TrimSpace(library_type)
-								cram.Library_type = library_type
-								break
-							}
-						}
-						if library_type != "" {
-							break
-						}
-					}
-				}
-				for _, line := range split_imeta {
-					if bytes.Contains(line, []byte("attribute: "+attribute_with_sample_name)) {
-						line_split := strings.Split(strings.TrimSuffix(string(line), "\n"), "\n")
-						for _, l := range line_split {
-							if strings.Contains(l, "value:") {
-								sample_name = strings.ReplaceAll(l, "value:", "")
-								sample_name = strings.TrimSpace(sample_name)
-								cram.Sample_name = sample_name
-								cram.Imeta_parsed = true
-								break
-							}
-						}
-						// as this loop goes line by line, this break means it stops when the first sample_name is found.
-						if sample_name != "" {
-							break
-						}
-					}
-				}
-			}
-		}
-
-		log.Println("Checking there are no duplicate sample names in parsed imeta information")
-		sample_names_map := make(map[string][]string)
-		for i := range cram_list {
-			cram := &cram_list[i]
-			if cram.Imeta_downloaded {
-				if cram.Library_type != "" {
-					sample_names_map[cram.Library_type] = []string{}
-				}
-			}
-		}
-
-		if len(sample_names_map) == 0 {
-			log.Fatalln("There are no library_type information for samples")
-		}
-
-		for i := range cram_list {
-			cram := &cram_list[i]
-			if cram.Imeta_downloaded {
-				if cram.Library_type != "" {
-					if stringInSlice(cram.Sample_name, sample_names_map[cram.Library_type]) {
-						log.Printf("Duplicate sample_names found for %s", cram.Sample_name)
-						log.Fatalln("There are duplicate values in sample_names, double check your choice of 'attribute_with_sample_name'")
-					}
-					sample_names_map[cram.Library_type] = append(sample_names_map[cram.Library_type], cram.Sample_name)
-				}
-			}
-		}
-
-		writeCheckpoint(cram_list, current_step)
+	where_conditions, err := parseWhere(where)
+	if err != nil {
+		log.Fatalln(err)
 	}
+	sel.where = where_conditions
 
-	current_step = 4
-	// if fastq have already been split then load checkpoint instead of rerunning
-	if fileExists(fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &cram_list)
-		if err != nil {
-			panic(err)
-		}
-
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
-
-	} else {
-		log.Println(fmt.Sprintf("Starting step %d", current_step))
-
-		log.Println("Extracting fastq from downloaded crams")
-		err := os.Mkdir("B_Fastq_Extraction", 0755)
-		if err != nil {
-			log.Fatal(err)
-		}
+	if len(run_lanes) == 0 && sel.empty() {
+		log.Fatalln("No lane or run argument was provided, nor any of --study, --sample-file or --where")
+	}
 
-		// extract fastq from downloaded cram files
-		fastq_cram_map := make(map[string]string)
-		for i := range cram_list {
-			cram := &cram_list[i]
-			if cram.Imeta_parsed {
-
-				fastq_cram_map[cram.Filename] = "B_Fastq_Extraction/B_cram_to_fastq_" + cram.Filename + ".o"
-				fq_filename := strings.ReplaceAll(cram.Filename, ".cram", "")
-				cram.Fastq_1_path = "B_Fastq_Extraction/" + fq_filename + ".1.fq.gz"
-				cram.Fastq_2_path = "B_Fastq_Extraction/" + fq_filename + ".2.fq.gz"
-
-				output, err := exec.Command(
-					"bsub",
-					"-o", "B_Fastq_Extraction/B_cram_to_fastq_"+cram.Filename+".o",
-					"-e", "B_Fastq_Extraction/B_cram_to_fastq_"+cram.Filename+".e",
-					"-R'select[mem>2000] rusage[mem=2000]'", "-M2000",
-					"-n", "4",
-					samtools_exec, "fastq", "-c", "7", "-@", "4",
-					"-1", cram.Fastq_1_path,
-					"-2", cram.Fastq_2_path,
-					"-0", "/dev/null",
-					"-s", "/dev/null",
-					"-n", cram.Cram_dl_path).CombinedOutput()
-
-				if err != nil {
-					// Display everything we got if error.
-					log.Println("Error when running command.  Output:")
-					log.Println(string(output))
-					log.Printf("Got command status: %s\n", err.Error())
-					return
-				}
-			}
-		}
+	cfg, sched, err := loadConfig(project_root)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-		// verify extracting the crams into fastq finished successfully
-		log.Println("Verifying success of extracting fastq")
+	// every path used by the pipeline is relative to the project root, which
+	// a dry run doesn't create
+	if !dry_run {
+		err = os.MkdirAll(project_root, 0755)
+	}
+	if err == nil && (!dry_run || fileExists(project_root)) {
+		err = os.Chdir(project_root)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-		bjobsIsCompleted(fastq_cram_map, "Fastq_extracted_success", &cram_list)
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-		writeCheckpoint(cram_list, current_step)
+	p := &pipeline{
+		cfg:        cfg,
+		sched:      sched,
+		irods:      irods.NewIcommandsClient(irods_zone),
+		executable: executable,
+		run_lanes:  run_lanes,
+		dry_run:    dry_run,
 	}
 
-	current_step = 5
-	// if symlinks already created then load session information and continue
-	// if fastq have already been split then load checkpoint instead of rerunning
-	if fileExists(fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &cram_list)
-		if err != nil {
-			panic(err)
+	// check the config before iRODS is queried, so that a misconfiguration is
+	// found now rather than inside a job hours later. A dry run only warns.
+	if !skip_check {
+		failed := failedChecks(preflightChecks(cfg, sched, p.irods))
+		for _, check := range failed {
+			log.Printf("Check of %s %s failed: %s\n", check.Name, check.Value, check.Err)
 		}
-
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
-
-	} else {
-
-		log.Println("Symlinking fastq into different folders based on library_type")
-		for i := range cram_list {
-			cram := &cram_list[i]
-			if cram.Fastq_extracted_success && cram.Library_type != "" {
-				lib_type_dir := strings.ReplaceAll(cram.Library_type, " ", "_")
-				lib_type_dir = "C_Split_by_Library_Type/" + lib_type_dir
-				_ = os.MkdirAll(lib_type_dir, 0755)
-				os.Symlink("../../"+cram.Fastq_1_path, lib_type_dir+"/"+cram.Sample_name+".1.fq.gz")
-				os.Symlink("../../"+cram.Fastq_2_path, lib_type_dir+"/"+cram.Sample_name+".2.fq.gz")
-				cram.Symlinked_fq_1 = lib_type_dir + "/" + cram.Sample_name + ".1.fq.gz"
-				cram.Symlinked_fq_2 = lib_type_dir + "/" + cram.Sample_name + ".2.fq.gz"
-			}
+		if len(failed) > 0 && !dry_run {
+			log.Fatalln("Pre-flight checks failed, see \"irods_downloader check\" for details")
 		}
-
-		writeCheckpoint(cram_list, current_step)
 	}
 
-	current_step = 6
-	// if alignments already performed then load session information and continue
-	if fileExists(fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &cram_list)
+	if !sel.empty() {
+		selected_run_lanes, err := p.selectRunLanes(sel)
 		if err != nil {
-			panic(err)
+			log.Fatalln(err)
 		}
+		p.run_lanes = uniqueRunLanes(append(p.run_lanes, selected_run_lanes...))
+	}
 
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
-
-	} else {
-
-		_ = os.MkdirAll("D_realignments/", 0755)
-		log.Println("Running alignments between extracted fastq and specified reference")
-		realignment_map := make(map[string]string)
-		for i := range cram_list {
-			cram := &cram_list[i]
-			if cram.Symlinked_fq_1 != "" && cram.Symlinked_fq_2 != "" {
-
-				out_folder := "D_realignments/" + strings.ReplaceAll(cram.Library_type, " ", "_") + "/"
-				_ = os.MkdirAll(out_folder, 0755)
-
-				bam_output := out_folder + cram.Sample_name + ".bam"
-				job_out := out_folder + "/D_realignement_RNA_" + cram.Sample_name + ".o"
-				job_err := out_folder + "/D_realignement_RNA_" + cram.Sample_name + ".e"
-
-				if stringInSlice(cram.Library_type, star_align_libraries) {
-					output, err := exec.Command(
-						"bsub",
-						"-o", job_out,
-						"-e", job_err,
-						"-n", "10",
-						"-R'select[mem>"+star_ram+"] rusage[mem="+star_ram+"]'", "-M"+star_ram,
-						star_exec, "--runThreadN", "21",
-						"--outSAMattributes", "NH", "HI", "NM", "MD",
-						"--limitBAMsortRAM", star_ram+"000000",
-						"--genomeDir", star_genome_dir,
-						"--readFilesCommand", "zcat",
-						"--outFileNamePrefix", out_folder+"/"+cram.Filename,
-						"--readFilesIn", cram.Symlinked_fq_1, cram.Symlinked_fq_2,
-						"--outStd", "BAM_SortedByCoordinate",
-						"|", samtools_exec, "sort", "-@3", "-l7", "-o", bam_output).CombinedOutput()
-
-					if err != nil {
-						// Display everything we got if error.
-						log.Println("Error when running command.  Output:")
-						log.Println(string(output))
-						log.Printf("Got command status: %s\n", err.Error())
-						return
-					}
-
-					cram.Realigned_bam_path = bam_output
-					realignment_map[cram.Filename] = job_out
-
-				} else if stringInSlice(cram.Library_type, bwa_align_libraries) {
-					output, err := exec.Command(
-						"bsub",
-						"-o", job_out,
-						"-e", job_err,
-						"-R'select[mem>"+bwa_ram+"] rusage[mem="+bwa_ram+"]'", "-M"+bwa_ram,
-						"-n", "10",
-						bwa_exec, "mem", "-t", "10",
-						bwa_genome_ref,
-						cram.Symlinked_fq_1,
-						cram.Symlinked_fq_2,
-						"|", samtools_exec, "sort", "-@3", "-l7", "-o", bam_output).CombinedOutput()
-
-					if err != nil {
-						// Display everything we got if error.
-						log.Println("Error when running command.  Output:")
-						log.Println(string(output))
-						log.Printf("Got command status: %s\n", err.Error())
-						return
-					}
-
-					cram.Realigned_bam_path = bam_output
-					realignment_map[cram.Filename] = job_out
-				}
-			}
+	// a dry run doesn't write the checkpoints, so can run alongside another
+	if !dry_run {
+		if err := lockProject("."); err != nil {
+			log.Fatalln(err)
 		}
+	}
 
-		// check on alignment jobs until they have finished
-		bjobsIsCompleted(realignment_map, "Realigned_succesful", &cram_list)
-
-		writeCheckpoint(cram_list, current_step)
+	p.loadOrQuery()
+	if dry_run {
+		p.dryRun()
+		return
 	}
+	p.catchInterrupts()
+	p.advanceCrams()
 
-	current_step = 7
-	// if quickcheck has already been performed then load session information and continue
-	if fileExists(fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &cram_list)
-		if err != nil {
-			panic(err)
+	for _, rl := range p.run_lanes {
+		if rl.failed {
+			log.Printf("%s failed and was not fully processed", rl)
 		}
+	}
 
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
+	// the report is written whether or not the counts matrix could be built,
+	// as it is most needed when something has failed
+	counts_err := p.countFeatures()
+	if counts_err != nil {
+		log.Println(counts_err)
+	}
 
+	if err := p.writeMultiqcLayout(); err != nil {
+		log.Printf("Unable to write MultiQC layout: %s\n", err.Error())
+	}
+	if err := writeReport("."); err != nil {
+		log.Printf("Unable to write report: %s\n", err.Error())
 	} else {
-		log.Println("Running samtools quickcheck on completed bams")
-
-		for i := range cram_list {
-			cram := &cram_list[i]
-			if cram.Realigned_succesful {
-				wg.Add(1)
-				go quickcheck_alignments(cram_list, i, samtools_exec)
-			}
-		}
-		wg.Wait() // wait until all quickcheck processes have finished
+		log.Printf("Report written to %s and %s\n", report_html_filename, report_json_filename)
+	}
 
-		writeCheckpoint(cram_list, current_step)
+	unlockProject(".")
+	if counts_err != nil {
+		os.Exit(1)
 	}
+}
 
-	current_step = 8
-	// if quickcheck has already been performed then load session information and continue
-	if fileExists(fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &cram_list)
-		if err != nil {
-			panic(err)
-		}
+// loadConfig reads irods_downloader_config.yaml from the project root, the
+// working directory or ~/.config, falling back to the defaults for any
+// settings it doesn't give, and creates the scheduler it names.
+func loadConfig(project_root string) (pipeline_config, scheduler, error) {
+	// we want to load a config file named "irods_downloader_config.yaml" if it exists in WD or in ~/.config
+	viper.SetConfigName("irods_downloader_config")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath(project_root)     // look for config in the project root first
+	viper.AddConfigPath(".")              // then in the working directory
+	viper.AddConfigPath("$HOME/.config/") // if not found then look in .config folder
 
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
+	viper.SetDefault("scheduler", "lsf")
+	viper.SetDefault("scheduler_queue", "")
+	viper.SetDefault("local_max_jobs", runtime.NumCPU())
 
-	} else {
-		log.Println("Indexing quickchecked bams")
-
-		for i := range cram_list {
-			cram := &cram_list[i]
-			if cram.Realigned_quickcheck_success {
-				wg.Add(1)
-				indexBam(cram_list, i, samtools_exec)
-			}
-		}
-		wg.Wait() // wait until all quickcheck processes have finished
+	viper.SetDefault("job_max_attempts", 3)
+	viper.SetDefault("job_retry_backoff", 60)
+	viper.SetDefault("job_memory_escalation", 1.5)
+	viper.SetDefault("job_timeouts", map[string]string{})
+	viper.SetDefault("on_interrupt", interrupt_detach)
 
-		writeCheckpoint(cram_list, current_step)
-	}
+	viper.SetDefault("retain_crams", true)
+	viper.SetDefault("retain_fastqs", true)
 
-	current_step = 9
-	// if counts matrix has already been built then load session info
-	if fileExists(fmt.Sprintf("checkpoint_%d.json", current_step)) {
-		jsonFile, err := os.Open(fmt.Sprintf("checkpoint_%d.json", current_step))
-		byteValue, _ := ioutil.ReadAll(jsonFile)
-		err = json.Unmarshal([]byte(byteValue), &cram_list)
-		if err != nil {
-			panic(err)
-		}
+	viper.SetDefault("star_align_libraries", []string{"GnT scRNA"})
+	viper.SetDefault("bwa_align_libraries", []string{"GnT Picoplex"})
 
-		log.Println(fmt.Sprintf("Checkpoint exists for step %d, loading progress", current_step))
+	viper.SetDefault("library_type_attribute", "library_type")
+	viper.SetDefault("attribute_with_sample_name", "sample_supplier_name")
+	viper.SetDefault("required_attributes", []string{})
+	viper.SetDefault("read_group_library_attribute", "library_id")
+	viper.SetDefault("read_group_platform", "ILLUMINA")
+	viper.SetDefault("merge_samples_across_lanes", false)
+	viper.SetDefault("paired_attribute", "is_paired_read")
+	viper.SetDefault("index_read_libraries", []string{})
+	viper.SetDefault("stream_fastqs", false)
+	viper.SetDefault("upload_collection", "")
+	viper.SetDefault("multiqc_dir", "")
+	viper.SetDefault(
+		"samtools_exec",
+		"/software/CASM/modules/installs/samtools/samtools-1.11/bin/samtools",
+	)
+	viper.SetDefault(
+		"star_exec",
+		"/nfs/users/nfs_r/rr11/Tools/STAR-2.5.2a/bin/Linux_x86_64_static/STAR",
+	)
+	viper.SetDefault("star_ram", "50000")
+	viper.SetDefault(
+		"star_genome_dir",
+		"/lustre/scratch119/casm/team78pipelines/reference/human/GRCh37d5_ERCC92/star/75/",
+	)
+	viper.SetDefault("bwa_exec", "/software/CASM/modules/installs/bwa/bwa-0.7.17/bin/bwa")
+	viper.SetDefault("bwa_ram", "50000")
+	viper.SetDefault(
+		"bwa_genome_ref",
+		"/lustre/scratch119/casm/team78pipelines/reference/human/GRCH37d5/genome.fa",
+	)
+	viper.SetDefault(
+		"featurecounts_exec",
+		"/nfs/users/nfs_s/sl31/Tools/subread-2.0.1-Linux-x86_64/bin/featureCounts",
+	)
+	viper.SetDefault("featurecounts_ram", "20000")
+	viper.SetDefault(
+		"genome_annot",
+		"/nfs/users/nfs_s/sl31/ref/hg19_cDNA_gene_name_featurecounts.gtf",
+	)
 
-	} else {
-		log.Println("Running featurecounts on completed RNA bams")
-		var rna_bams_featurecounts_input []string
-
-		for i := range cram_list {
-			cram := &cram_list[i]
-			// if quickcheck worked then add its realigned and sorted bam path to list of bams to include in counts matrix
-			if cram.Realigned_quickcheck_success {
-				if stringInSlice(cram.Library_type, star_align_libraries) {
-					rna_bams_featurecounts_input = append(rna_bams_featurecounts_input, cram.Realigned_bam_path)
-
-				}
-			}
-		}
+	// read in config file if found, else use defaults
+	if err := viper.ReadInConfig(); err != nil {
+		return pipeline_config{}, nil, fmt.Errorf("unable to read config file: %s", err.Error())
+	}
 
-		if len(rna_bams_featurecounts_input) < 1 {
-			log.Fatalln("Less than  1 bams in RNA category, not enough for featurecounts, aborting.")
-		}
+	// Config file found and successfully parsed
+	sched, err := newScheduler(
+		viper.GetString("scheduler"),
+		viper.GetString("scheduler_queue"),
+		viper.GetInt("local_max_jobs"),
+	)
+	if err != nil {
+		return pipeline_config{}, nil, err
+	}
 
-		err := os.Mkdir("E_Counts_matrix_RNA", 0755)
-		if err != nil {
-			log.Fatal(err)
-		}
+	aligners, library_aligners, err := alignerProfilesFromConfig()
+	if err != nil {
+		return pipeline_config{}, nil, err
+	}
 
-		matrix_out := "E_Counts_matrix_RNA/featurecounts_matrix.tsv"
-		job_out := "E_Counts_matrix_RNA/featurecounts_run.o"
-		job_err := "E_Counts_matrix_RNA/featurecounts_run.e"
-
-		featureCountsCmd := []string{
-			"-o", job_out,
-			"-e", job_err,
-			"-R'select[mem>" + featurecounts_ram + "] rusage[mem=" + featurecounts_ram + "]'", "-M" + featurecounts_ram,
-			"-n", "14",
-			featurecounts_exec,
-			"-Q", "30",
-			"-p",
-			"-t", "exon",
-			"-g", "gene_name",
-			"-F", "GTF",
-			"-a", genome_annot,
-			"-o", matrix_out}
-
-		// append bam paths to end of command options, as this is what featureCounts expects
-		featureCountsCmd = append(featureCountsCmd, rna_bams_featurecounts_input...)
-
-		output, err := exec.Command("bsub", featureCountsCmd...).CombinedOutput()
+	on_interrupt, err := parseInterruptAction(viper.GetString("on_interrupt"))
+	if err != nil {
+		return pipeline_config{}, nil, err
+	}
 
-		if err != nil {
-			// Display everything we got if error.
-			log.Println("Error when running command.  Output:")
-			log.Println(string(output))
-			log.Printf("Got command status: %s\n", err.Error())
-			return
-		}
+	job_timeouts, err := jobTimeoutsFromConfig()
+	if err != nil {
+		return pipeline_config{}, nil, err
+	}
 
-		// wait for featurecounts job to finish
-		for {
-			dat, err := ioutil.ReadFile(job_out)
-			if err == nil {
-				if strings.Contains(string(dat), "Terminated at") {
-					break
-				}
-			}
-			time.Sleep(5 * time.Second)
-		}
+	qc_thresholds, err := qcThresholdsFromConfig()
+	if err != nil {
+		return pipeline_config{}, nil, err
+	}
 
-		// if featurecounts exited successfuly write new checkpoint file
-		// this doesn't have any new information but its presence will indicate not to repeat the featurecounts step
-		dat, err := ioutil.ReadFile(job_out)
-		if err == nil {
-			if strings.Contains(string(dat), "Successfully completed.") {
-				writeCheckpoint(cram_list, current_step)
-			} else {
-				log.Fatalln("Featurecounts did not exit successfully")
-			}
-		}
+	cfg := pipeline_config{
+		Library_type_attribute:       viper.GetString("library_type_attribute"),
+		Attribute_with_sample_name:   viper.GetString("attribute_with_sample_name"),
+		Required_attributes:          viper.GetStringSlice("required_attributes"),
+		Read_group_library_attribute: viper.GetString("read_group_library_attribute"),
+		Read_group_platform:          viper.GetString("read_group_platform"),
+		Merge_samples_across_lanes:   viper.GetBool("merge_samples_across_lanes"),
+		Paired_attribute:             viper.GetString("paired_attribute"),
+		Index_read_libraries:         viper.GetStringSlice("index_read_libraries"),
+		Stream_fastqs:                viper.GetBool("stream_fastqs"),
+		Upload_collection:            strings.TrimSuffix(viper.GetString("upload_collection"), "/"),
+		Samtools_exec:                viper.GetString("samtools_exec"),
+		Aligners:                     aligners,
+		Library_aligners:             library_aligners,
+		Qc_thresholds:                qc_thresholds,
+		Multiqc_dir:                  strings.TrimSuffix(viper.GetString("multiqc_dir"), "/"),
+		Featurecounts_exec:           viper.GetString("featurecounts_exec"),
+		Featurecounts_ram:            viper.GetInt("featurecounts_ram"),
+		Genome_annot:                 viper.GetString("genome_annot"),
+		Job_max_attempts:             viper.GetInt("job_max_attempts"),
+		Job_retry_backoff:            time.Duration(viper.GetInt("job_retry_backoff")) * time.Second,
+		Job_memory_escalation:        viper.GetFloat64("job_memory_escalation"),
+		Job_timeouts:                 job_timeouts,
+		On_interrupt:                 on_interrupt,
+		Retain_crams:                 viper.GetBool("retain_crams"),
+		Retain_fastqs:                viper.GetBool("retain_fastqs"),
 	}
+	return cfg, sched, nil
 }
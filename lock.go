@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lock_filename is created in the project root by the irods_downloader that
+// is writing the project's checkpoints, so that another pipeline or cleanup
+// can't rewrite them at the same time
+const lock_filename = "irods_downloader.lock"
+
+// lockProject takes the lock of the project, recording the host and pid of
+// this process in it. A lock left behind by a process that is no longer
+// running on this host is taken over, while one held from another host can't
+// be checked, so has to be removed by hand.
+func lockProject(project_root string) error {
+	lock_path := filepath.Join(project_root, lock_filename)
+	hostname, _ := os.Hostname()
+	for {
+		lock_file, err := os.OpenFile(lock_path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(lock_file, "%s %d\n", hostname, os.Getpid())
+			if close_err := lock_file.Close(); err == nil {
+				err = close_err
+			}
+			return err
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		dat, err := ioutil.ReadFile(lock_path)
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(string(dat))
+		if len(fields) != 2 || fields[0] != hostname {
+			return fmt.Errorf("%s is in use by irods_downloader on %s, remove it if that is no longer running", lock_path, strings.TrimSpace(string(dat)))
+		}
+		pid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %s", lock_path, err.Error())
+		}
+		if processIsRunning(pid) {
+			return fmt.Errorf("%s is in use by irods_downloader with pid %d", lock_path, pid)
+		}
+
+		log.Printf("Taking over %s from pid %d, which is no longer running\n", lock_path, pid)
+		err = os.Remove(lock_path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+}
+
+// unlockProject releases the lock taken by lockProject
+func unlockProject(project_root string) {
+	err := os.Remove(filepath.Join(project_root, lock_filename))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+}
+
+// processIsRunning reports whether a process with the pid exists, which
+// signal 0 checks without sending anything
+func processIsRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// writeMultiqcLayout gathers the QC output of the project into multiqc_dir,
+// named by sample rather than by iRODS filename so that MultiQC reports each
+// sample under its sample name. Each library_type has its own directory, as
+// the same sample can be sequenced with several library types. The samtools
+// output and STAR logs are symlinked, and the featureCounts summary is copied
+// with its bam paths replaced by sample names. A multiqc_config.yaml mapping
+// iRODS filenames to sample names is written alongside them, for anything
+// else MultiQC finds named after a CRAM.
+func (p *pipeline) writeMultiqcLayout() error {
+	if p.cfg.Multiqc_dir == "" {
+		return nil
+	}
+	crams := cramsOf(p.activeRunLanes())
+
+	sample_names := make(map[string]string)
+	for _, cram := range crams {
+		if cram.Sample_name == "" {
+			continue
+		}
+		sample_names[strings.TrimSuffix(cram.Filename, ".cram")] = cram.Sample_name
+		library_dir := filepath.Join(p.cfg.Multiqc_dir, strings.ReplaceAll(cram.Library_type, " ", "_"))
+
+		var links [][2]string
+		// crams merged into another's sample share its bam
+		if cram.Qc_metrics != nil && cram.Merged_into == "" {
+			flagstat, stats, idxstats := qcPaths(cram.Realigned_bam_path)
+			links = append(links,
+				[2]string{flagstat, filepath.Join(library_dir, cram.Sample_name+".flagstat")},
+				[2]string{stats, filepath.Join(library_dir, cram.Sample_name+".stats")},
+				[2]string{idxstats, filepath.Join(library_dir, cram.Sample_name+".idxstats")},
+			)
+		}
+		if cram.Aligner_out_prefix != "" && fileExists(starLogPath(cram.Aligner_out_prefix)) {
+			// each lane of a merged sample is aligned, and so logged, separately
+			log_name := cram.Sample_name
+			if p.cfg.Merge_samples_across_lanes {
+				log_name = cram.Sample_name + "_" + strings.TrimSuffix(cram.Filename, ".cram")
+			}
+			links = append(links, [2]string{
+				starLogPath(cram.Aligner_out_prefix), filepath.Join(library_dir, log_name+".Log.final.out"),
+			})
+		}
+
+		if len(links) == 0 {
+			continue
+		}
+		if err := os.MkdirAll(library_dir, 0755); err != nil {
+			return err
+		}
+		for _, link := range links {
+			relativeSymlink(link[0], link[1])
+		}
+	}
+
+	if err := p.writeMultiqcCounts(crams); err != nil {
+		return err
+	}
+	return writeMultiqcConfig(filepath.Join(p.cfg.Multiqc_dir, "multiqc_config.yaml"), sample_names)
+}
+
+// writeMultiqcCounts copies the featureCounts summary into multiqc_dir, with
+// the bam path heading each column replaced by the bam's sample name
+func (p *pipeline) writeMultiqcCounts(crams []*cram_file) error {
+	dat, err := ioutil.ReadFile(counts_matrix_path + ".summary")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	bam_samples := make(map[string]string)
+	for _, cram := range crams {
+		if cram.Merged_into == "" && cram.Realigned_bam_path != "" {
+			bam_samples[cram.Realigned_bam_path] = cram.Sample_name
+		}
+	}
+
+	lines := strings.SplitN(string(dat), "\n", 2)
+	header := strings.Split(lines[0], "\t")
+	for i, bam := range header {
+		if sample_name, ok := bam_samples[bam]; ok && i > 0 {
+			header[i] = sample_name
+		}
+	}
+	lines[0] = strings.Join(header, "\t")
+
+	counts_dir := filepath.Join(p.cfg.Multiqc_dir, filepath.Base(filepath.Dir(counts_matrix_path)))
+	if err := os.MkdirAll(counts_dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(
+		filepath.Join(counts_dir, "featurecounts.summary"), []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// writeMultiqcConfig writes a MultiQC config that renames any sample named
+// after the iRODS filename of a CRAM, with or without .cram and followed by
+// anything such as the read number of its fastqs, to the CRAM's sample name
+func writeMultiqcConfig(config_path string, sample_names map[string]string) error {
+	var stems []string
+	for stem := range sample_names {
+		stems = append(stems, stem)
+	}
+	sort.Strings(stems)
+
+	// every value is written as a JSON string, which is also valid YAML
+	quote := func(value string) string {
+		quoted, _ := json.Marshal(value)
+		return string(quoted)
+	}
+
+	var config strings.Builder
+	config.WriteString("# written by iRODS-Downloader, which rewrites this file at the end of every run\n")
+	config.WriteString("extra_fn_clean_exts:\n")
+	for _, ext := range []string{".flagstat", ".idxstats", ".stats", ".Log.final.out"} {
+		fmt.Fprintf(&config, "  - %s\n", quote(ext))
+	}
+	config.WriteString("sample_names_replace_regex: true\n")
+	config.WriteString("sample_names_replace:\n")
+	for _, stem := range stems {
+		search := "^" + regexp.QuoteMeta(stem) + `(\.cram)?(?=[._]|$)`
+		fmt.Fprintf(&config, "  %s: %s\n", quote(search), quote(sample_names[stem]))
+	}
+	return ioutil.WriteFile(config_path, []byte(config.String()), 0644)
+}
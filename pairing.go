@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// detectPairing works out whether the cram's reads are single-end, from its
+// paired_attribute in iRODS when it has one and otherwise from the flags of
+// its first read
+func (p *pipeline) detectPairing(cram *cram_file) error {
+	if paired, ok := cram.attribute(p.cfg.Paired_attribute); ok {
+		cram.Single_end = paired == "0"
+		return nil
+	}
+
+	paired, err := firstReadPaired(p.cfg.Samtools_exec, cram.Cram_dl_path)
+	if err != nil {
+		return err
+	}
+	cram.Single_end = !paired
+	return nil
+}
+
+// firstReadPaired reads the flags of the first primary alignment in the cram,
+// without decoding the sequences, and reports whether it is paired
+func firstReadPaired(samtools_exec string, cram_path string) (bool, error) {
+	cmd := exec.Command(samtools_exec, "view",
+		"--input-fmt-option", "required_fields=0x2", "-F", "0x900", cram_path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return false, err
+	}
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	line, _ := bufio.NewReader(stdout).ReadString('\n')
+	// only the first read is needed, so samtools is stopped rather than left
+	// to read the whole cram
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	fields := strings.Split(line, "\t")
+	if len(fields) < 2 {
+		return false, fmt.Errorf("no reads found in %s: %s", cram_path, strings.TrimSpace(stderr.String()))
+	}
+	flag, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return false, fmt.Errorf("unable to read flag of first read in %s: %s", cram_path, line)
+	}
+	return flag&0x1 != 0, nil
+}
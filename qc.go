@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// qc_metrics are the alignment metrics of a bam, as percentages of its
+// primary reads. Duplicates are those samtools markdup marks in a copy of the
+// bam made by the QC job. Star holds the metrics STAR reports in its
+// Log.final.out, summed over every lane of a merged sample, and is nil for
+// bams aligned with anything else.
+type qc_metrics struct {
+	Total_reads             int64
+	Mapped_reads            int64
+	Mapping_percent         float64
+	Duplicate_percent       float64
+	Properly_paired_percent float64
+	Mitochondrial_percent   float64
+	Star                    *star_metrics
+}
+
+type star_metrics struct {
+	Input_reads             int64
+	Uniquely_mapped_percent float64
+	Multi_mapped_percent    float64
+}
+
+// qc_thresholds are the limits a bam's metrics are flagged outside of. A
+// threshold of 0 isn't checked.
+type qc_thresholds struct {
+	Min_mapping_percent         float64
+	Max_duplicate_percent       float64
+	Min_properly_paired_percent float64
+	Max_mitochondrial_percent   float64
+	Min_uniquely_mapped_percent float64
+}
+
+// contigs reads on which count towards Mitochondrial_percent
+var mitochondrial_contigs = []string{"chrM", "MT", "chrMT", "M"}
+
+// qcThresholdsFromConfig reads qc_thresholds, which gives the thresholds of
+// each library_type, falling back to those given as "default". As with
+// library_aligners, library_types are matched in lower case.
+func qcThresholdsFromConfig() (map[string]qc_thresholds, error) {
+	thresholds := make(map[string]qc_thresholds)
+	if err := viper.UnmarshalKey("qc_thresholds", &thresholds); err != nil {
+		return nil, fmt.Errorf("unable to read qc_thresholds: %s", err.Error())
+	}
+	lower := make(map[string]qc_thresholds)
+	for library_type, limits := range thresholds {
+		lower[strings.ToLower(library_type)] = limits
+	}
+	return lower, nil
+}
+
+// qcThresholds returns the thresholds the bams of the library_type are checked
+// against
+func (p *pipeline) qcThresholds(library_type string) qc_thresholds {
+	if limits, ok := p.cfg.Qc_thresholds[strings.ToLower(library_type)]; ok {
+		return limits
+	}
+	return p.cfg.Qc_thresholds["default"]
+}
+
+// stageAfterQc is the stage a cram moves to once its bam's metrics are
+// collected, which is uploading it if an upload_collection is configured and
+// it hasn't been already
+func (p *pipeline) stageAfterQc(cram *cram_file) string {
+	if p.cfg.Upload_collection != "" && !cram.Uploaded {
+		return stage_upload
+	}
+	return stage_done
+}
+
+// queueQc sends a cram that finished before metrics were collected back to
+// have them collected
+func (p *pipeline) queueQc(cram *cram_file) {
+	if cram.Stage == stage_done && cram.Realigned_index_success && cram.Qc_metrics == nil {
+		cram.Stage = stage_qc
+	}
+}
+
+// qcPaths returns where the flagstat, stats and idxstats output of the bam
+// are written, alongside it
+func qcPaths(bam string) (string, string, string) {
+	prefix := strings.TrimSuffix(bam, ".bam")
+	return prefix + ".flagstat", prefix + ".stats", prefix + ".idxstats"
+}
+
+// starLogPath is where STAR writes its summary of an alignment run with the
+// out_prefix
+func starLogPath(out_prefix string) string {
+	return out_prefix + "Log.final.out"
+}
+
+// qcJob runs samtools flagstat, stats and idxstats on the cram's bam, keeping
+// their output alongside it. The bams aren't marked for duplicates, so stats
+// is run on a copy of the bam streamed through samtools markdup, which needs
+// the mate tags fixmate adds to name collated reads. fixmate is kept from
+// changing the proper pair flags, so that only the duplicates differ from the
+// bam.
+func (p *pipeline) qcJob(cram *cram_file) job_spec {
+	bam := cram.Realigned_bam_path
+	flagstat, stats, idxstats := qcPaths(bam)
+	tmp_prefix := strings.TrimSuffix(bam, ".bam") + ".markdup"
+
+	markdup_cmds := [][]string{
+		{p.cfg.Samtools_exec, "collate", "-O", "-u", "-@", "2", bam, tmp_prefix + ".collate"},
+		{p.cfg.Samtools_exec, "fixmate", "-m", "-p", "-@", "2", "-", "-"},
+		{p.cfg.Samtools_exec, "sort", "-l", "0", "-@", "2", "-T", tmp_prefix + ".sort", "-"},
+		{p.cfg.Samtools_exec, "markdup", "-@", "2", "-", "-"},
+		{p.cfg.Samtools_exec, "stats", "-@", "2", "-"},
+	}
+	var markdup_pipeline []string
+	for _, cmd := range markdup_cmds {
+		markdup_pipeline = append(markdup_pipeline, shellQuote(cmd))
+	}
+
+	job_prefix := filepath.Dir(bam) + "/D_qc_metrics_" + bamName(cram)
+	return scriptJob(job_spec{
+		Name:    "D_qc_metrics_" + bamName(cram),
+		Stdout:  job_prefix + ".o",
+		Stderr:  job_prefix + ".e",
+		Memory:  4000,
+		Threads: 2,
+	}, job_prefix+".sh", []string{
+		shellQuote([]string{p.cfg.Samtools_exec, "flagstat", "-@", "2", bam}) + " > " + shellQuote([]string{flagstat}),
+		strings.Join(markdup_pipeline, " | ") + " > " + shellQuote([]string{stats}),
+		shellQuote([]string{p.cfg.Samtools_exec, "idxstats", bam}) + " > " + shellQuote([]string{idxstats}),
+	})
+}
+
+// readQcMetrics reads the metrics written by the cram's QC job, and those of
+// STAR if it aligned the bam, then flags the cram if they fall outside its
+// library type's thresholds.
+func (p *pipeline) readQcMetrics(cram *cram_file) error {
+	_, stats, idxstats := qcPaths(cram.Realigned_bam_path)
+	metrics, err := readSamtoolsStats(stats)
+	if err != nil {
+		return err
+	}
+	metrics.Mitochondrial_percent, err = readMitochondrialPercent(idxstats)
+	if err != nil {
+		return err
+	}
+
+	// each lane of a merged sample is aligned separately, so has its own log
+	var star_logs []string
+	for _, member := range cramsOf(p.activeRunLanes()) {
+		if member == cram || member.Merged_into == cram.Filename {
+			if member.Aligner_out_prefix != "" && fileExists(starLogPath(member.Aligner_out_prefix)) {
+				star_logs = append(star_logs, starLogPath(member.Aligner_out_prefix))
+			}
+		}
+	}
+	if aligner := p.alignerProfile(cram.Library_type); aligner != nil && aligner.Rna && len(star_logs) > 0 {
+		metrics.Star, err = readStarLogs(star_logs)
+		if err != nil {
+			return err
+		}
+	}
+
+	cram.Qc_metrics = metrics
+	cram.Qc_flags = qcFlags(metrics, p.qcThresholds(cram.Library_type), cram.Single_end)
+	for _, flag := range cram.Qc_flags {
+		log.Printf("QC of %s flagged: %s\n", cram.Filename, flag)
+	}
+	return nil
+}
+
+// readSamtoolsStats reads the summary numbers of samtools stats output
+func readSamtoolsStats(path string) (*qc_metrics, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	summary := make(map[string]int64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 || fields[0] != "SN" {
+			continue
+		}
+		value, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			// averages and ratios aren't needed
+			continue
+		}
+		summary[strings.TrimSuffix(fields[1], ":")] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	total, ok := summary["raw total sequences"]
+	if !ok {
+		return nil, fmt.Errorf("%s has no summary numbers", path)
+	}
+	metrics := &qc_metrics{
+		Total_reads:  total,
+		Mapped_reads: summary["reads mapped"],
+	}
+	metrics.Mapping_percent = percentOf(summary["reads mapped"], total)
+	metrics.Duplicate_percent = percentOf(summary["reads duplicated"], total)
+	metrics.Properly_paired_percent = percentOf(summary["reads properly paired"], total)
+	return metrics, nil
+}
+
+// readMitochondrialPercent reads the percentage of mapped reads that are on
+// the mitochondrial contig from samtools idxstats output
+func readMitochondrialPercent(path string) (float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var mapped, mitochondrial int64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 4 {
+			continue
+		}
+		reads, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unable to read %s: %s", path, err.Error())
+		}
+		mapped += reads
+		if stringInSlice(fields[0], mitochondrial_contigs) {
+			mitochondrial += reads
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return percentOf(mitochondrial, mapped), nil
+}
+
+// readStarLogs sums the read counts of STAR's Log.final.out files
+func readStarLogs(paths []string) (*star_metrics, error) {
+	var input, unique, multi int64
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]string)
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.SplitN(scanner.Text(), "|", 2)
+			if len(fields) == 2 {
+				values[strings.TrimSpace(fields[0])] = strings.TrimSpace(fields[1])
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		counts := make([]int64, 3)
+		for i, name := range []string{
+			"Number of input reads", "Uniquely mapped reads number", "Number of reads mapped to multiple loci",
+		} {
+			counts[i], err = strconv.ParseInt(values[name], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s has no '%s'", path, name)
+			}
+		}
+		input += counts[0]
+		unique += counts[1]
+		multi += counts[2]
+	}
+	return &star_metrics{
+		Input_reads:             input,
+		Uniquely_mapped_percent: percentOf(unique, input),
+		Multi_mapped_percent:    percentOf(multi, input),
+	}, nil
+}
+
+func percentOf(count int64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(count) / float64(total) * 100
+}
+
+// qcFlags returns a description of each threshold the metrics fall outside
+// of. The properly paired percentage of single-end bams isn't checked.
+func qcFlags(metrics *qc_metrics, limits qc_thresholds, single_end bool) []string {
+	var flags []string
+	below := func(name string, value float64, threshold float64) {
+		if threshold > 0 && value < threshold {
+			flags = append(flags, fmt.Sprintf("%s %.1f%% is below %.1f%%", name, value, threshold))
+		}
+	}
+	above := func(name string, value float64, threshold float64) {
+		if threshold > 0 && value > threshold {
+			flags = append(flags, fmt.Sprintf("%s %.1f%% is above %.1f%%", name, value, threshold))
+		}
+	}
+
+	below("mapping", metrics.Mapping_percent, limits.Min_mapping_percent)
+	above("duplicates", metrics.Duplicate_percent, limits.Max_duplicate_percent)
+	if !single_end {
+		below("properly paired", metrics.Properly_paired_percent, limits.Min_properly_paired_percent)
+	}
+	above("mitochondrial", metrics.Mitochondrial_percent, limits.Max_mitochondrial_percent)
+	if metrics.Star != nil {
+		below("uniquely mapped", metrics.Star.Uniquely_mapped_percent, limits.Min_uniquely_mapped_percent)
+	}
+	return flags
+}
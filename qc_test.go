@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestReadSamtoolsStats(t *testing.T) {
+	tests := []struct {
+		stats string
+		want  *qc_metrics
+	}{
+		{
+			"# This file was produced by samtools stats\n" +
+				"SN\traw total sequences:\t1000\t# excluding supplementary and secondary reads\n" +
+				"SN\treads mapped:\t750\n" +
+				"SN\treads duplicated:\t250\t# PCR or optical duplicate bit set\n" +
+				"SN\treads properly paired:\t500\t# proper-pair bit set\n" +
+				"SN\terror rate:\t1.234e-03\t# mismatches / bases mapped (cigar)\n" +
+				"FFQ\t1\t0\t1000\n",
+			&qc_metrics{Total_reads: 1000, Mapped_reads: 750, Mapping_percent: 75, Duplicate_percent: 25, Properly_paired_percent: 50},
+		},
+		{
+			"SN\traw total sequences:\t0\n",
+			&qc_metrics{},
+		},
+		{"# no summary numbers\nFFQ\t1\t0\t1000\n", nil},
+	}
+	dir, err := ioutil.TempDir("", "qc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, test := range tests {
+		path := filepath.Join(dir, strconv.Itoa(i)+".stats")
+		if err := ioutil.WriteFile(path, []byte(test.stats), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readSamtoolsStats(path)
+		if !reflect.DeepEqual(got, test.want) || (err != nil) != (test.want == nil) {
+			t.Errorf("readSamtoolsStats of %q = %+v, %v, want %+v", test.stats, got, err, test.want)
+		}
+	}
+
+	if _, err := readSamtoolsStats(filepath.Join(dir, "missing.stats")); err == nil {
+		t.Errorf("readSamtoolsStats of a missing file succeeded")
+	}
+}
+
+func TestQcFlags(t *testing.T) {
+	metrics := &qc_metrics{Mapping_percent: 75, Duplicate_percent: 25, Properly_paired_percent: 50}
+	tests := []struct {
+		limits     qc_thresholds
+		single_end bool
+		want       []string
+	}{
+		{qc_thresholds{}, false, nil},
+		{qc_thresholds{Min_mapping_percent: 70, Max_duplicate_percent: 30}, false, nil},
+		{qc_thresholds{Max_duplicate_percent: 20}, false, []string{"duplicates 25.0% is above 20.0%"}},
+		{qc_thresholds{Min_mapping_percent: 80, Min_properly_paired_percent: 60}, false, []string{
+			"mapping 75.0% is below 80.0%", "properly paired 50.0% is below 60.0%",
+		}},
+		{qc_thresholds{Min_properly_paired_percent: 60}, true, nil},
+	}
+	for _, test := range tests {
+		got := qcFlags(metrics, test.limits, test.single_end)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("qcFlags with %+v (single-end %v) = %q, want %q", test.limits, test.single_end, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+)
+
+// read_group holds the fields of the @RG header line the reads of a cram are
+// tagged with, which tools such as GATK and Picard require
+type read_group struct {
+	ID string // run, lane and tag of the cram
+	SM string // sample
+	LB string // library
+	PL string // sequencing platform
+	PU string // platform unit, the run and lane sequenced on and the tag
+}
+
+// readGroup builds the cram's read group from its filename, sample name and
+// iRODS metadata
+func (p *pipeline) readGroup(cram *cram_file) read_group {
+	id := strings.TrimSuffix(cram.Filename, ".cram")
+	run, lane, _ := runLaneOfFilename(cram.Filename)
+	tag := ""
+	if split_id := strings.SplitN(id, "#", 2); len(split_id) == 2 {
+		tag = split_id[1]
+	}
+	platform_unit := run + "." + lane
+	if tag != "" {
+		platform_unit += "." + tag
+	}
+
+	library, _ := cram.attribute(p.cfg.Read_group_library_attribute)
+	return read_group{
+		ID: id,
+		SM: cram.Sample_name,
+		LB: library,
+		PL: p.cfg.Read_group_platform,
+		PU: platform_unit,
+	}
+}
+
+// fields returns the read group's fields as "TAG:value", leaving out any that
+// are empty, as STAR's --outSAMattrRGline expects
+func (rg read_group) fields() []string {
+	var fields []string
+	for _, field := range [][]string{
+		{"ID", rg.ID}, {"SM", rg.SM}, {"LB", rg.LB}, {"PL", rg.PL}, {"PU", rg.PU},
+	} {
+		if field[1] != "" {
+			fields = append(fields, field[0]+":"+field[1])
+		}
+	}
+	return fields
+}
+
+// line returns the read group as a header line with its fields separated by
+// "\t", as given to bwa's -R
+func (rg read_group) line() string {
+	return `@RG\t` + strings.Join(rg.fields(), `\t`)
+}
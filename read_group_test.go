@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/seanlaidlaw/iRODS-Downloader/irods"
+)
+
+func TestReadGroup(t *testing.T) {
+	tests := []struct {
+		rg     read_group
+		fields []string
+		line   string
+	}{
+		{
+			read_group{ID: "1234_1#1", SM: "sample", LB: "lib", PL: "ILLUMINA", PU: "1234.1.1"},
+			[]string{"ID:1234_1#1", "SM:sample", "LB:lib", "PL:ILLUMINA", "PU:1234.1.1"},
+			`@RG\tID:1234_1#1\tSM:sample\tLB:lib\tPL:ILLUMINA\tPU:1234.1.1`,
+		},
+		{
+			read_group{ID: "1234_1", SM: "sample", PU: "1234.1"},
+			[]string{"ID:1234_1", "SM:sample", "PU:1234.1"},
+			`@RG\tID:1234_1\tSM:sample\tPU:1234.1`,
+		},
+	}
+	for _, test := range tests {
+		if got := test.rg.fields(); !reflect.DeepEqual(got, test.fields) {
+			t.Errorf("%+v.fields() = %v, want %v", test.rg, got, test.fields)
+		}
+		if got := test.rg.line(); got != test.line {
+			t.Errorf("%+v.line() = %s, want %s", test.rg, got, test.line)
+		}
+	}
+}
+
+func TestReadGroupOfCram(t *testing.T) {
+	p := &pipeline{cfg: pipeline_config{Read_group_library_attribute: "library_id", Read_group_platform: "ILLUMINA"}}
+	tests := []struct {
+		cram cram_file
+		want read_group
+	}{
+		{
+			cram_file{Filename: "1234_1#5.cram", Sample_name: "s1", Metadata: []irods.Avu{{Attribute: "library_id", Value: "99"}}},
+			read_group{ID: "1234_1#5", SM: "s1", LB: "99", PL: "ILLUMINA", PU: "1234.1.5"},
+		},
+		{
+			cram_file{Filename: "1234_2.cram", Sample_name: "s2"},
+			read_group{ID: "1234_2", SM: "s2", PL: "ILLUMINA", PU: "1234.2"},
+		},
+	}
+	for _, test := range tests {
+		if got := p.readGroup(&test.cram); got != test.want {
+			t.Errorf("readGroup(%s) = %+v, want %+v", test.cram.Filename, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/seanlaidlaw/iRODS-Downloader/irods"
+)
+
+// project_job is a job run once for the whole project, such as featureCounts.
+// It is saved as soon as it is submitted, so that a run that stops while
+// waiting on it can be reattached to it by the next run rather than
+// submitting it again.
+type project_job struct {
+	Stage     string
+	Job_id    string
+	Bams      []string
+	Submitted time.Time
+}
+
+// projectJobPath is where the job of the stage whose result is recorded in
+// checkpoint_file is saved while it runs
+func projectJobPath(checkpoint_file string) string {
+	return strings.TrimSuffix(checkpoint_file, ".json") + "_job.json"
+}
+
+// reattachJob keeps the job a cram was running when a previous invocation
+// stopped, so that it is waited on rather than submitted again, if the
+// scheduler kept it running. Otherwise the job is cancelled, killing anything
+// it left running so that it can't write to the outputs of the job replacing
+// it, and its stage is started again.
+func (p *pipeline) reattachJob(cram *cram_file) {
+	if cram.Job_id == "" {
+		return
+	}
+	if p.sched.Detachable() {
+		log.Printf("Reattaching to job %s of %s\n", cram.Job_id, cram.Filename)
+		return
+	}
+	if p.dry_run {
+		cram.Job_id = ""
+		return
+	}
+	p.cancelJob(cram)
+}
+
+// writeCheckpointOf saves the checkpoint of the cram's run/lane
+func (p *pipeline) writeCheckpointOf(cram *cram_file) {
+	for _, rl := range p.activeRunLanes() {
+		if rl.dir() == cram.Run_lane_dir {
+			rl.writeCheckpoint()
+		}
+	}
+}
+
+// runProjectJob runs the job of the stage for the given bams and waits for it
+// to finish, returning its exit status. If a previous run left the same job
+// running it is reattached to instead, and submitted again only if the
+// scheduler has since lost it.
+func (p *pipeline) runProjectJob(checkpoint_file string, stage string, job job_spec, bams []string) (int, error) {
+	job_file := projectJobPath(checkpoint_file)
+
+	var saved project_job
+	if dat, err := ioutil.ReadFile(job_file); err == nil && json.Unmarshal(dat, &saved) == nil {
+		state, err := p.sched.Poll(saved.Job_id)
+		if err == nil && state != job_lost && p.sched.Detachable() && reflect.DeepEqual(saved.Bams, bams) {
+			log.Printf("Reattaching to %s job %s\n", stage, saved.Job_id)
+			exit_status, err := p.waitForJob(saved, job_file)
+			os.Remove(job_file)
+			return exit_status, err
+		}
+		// a job that can't be waited on, or was of other bams, mustn't go on
+		// writing to the outputs of the job replacing it
+		if err == nil && state == job_lost {
+			log.Printf("%s job %s left running by a previous run was lost by the scheduler\n", stage, saved.Job_id)
+			p.sched.Cancel(saved.Job_id)
+		} else {
+			log.Printf("Cancelling %s job %s left running by a previous run\n", stage, saved.Job_id)
+			if err := p.sched.Cancel(saved.Job_id); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(job.Stdout), 0755)
+	if err == nil {
+		err = writeJobScript(job)
+	}
+	if err != nil {
+		return -1, err
+	}
+	job_id, err := p.sched.Submit(job)
+	if err != nil {
+		return -1, fmt.Errorf("Got submission status: %s", err.Error())
+	}
+
+	saved = project_job{Stage: stage, Job_id: job_id, Bams: bams, Submitted: time.Now()}
+	saved_json, _ := json.MarshalIndent(saved, "", "  ")
+	if err := ioutil.WriteFile(job_file, saved_json, 0644); err != nil {
+		log.Println(err)
+	}
+
+	exit_status, err := p.waitForJob(saved, job_file)
+	os.Remove(job_file)
+	return exit_status, err
+}
+
+// adoptOutputs checks whether the outputs of the cram's lost job are complete,
+// in which case they are used rather than running the job again. Only stages
+// whose outputs can be checked are adopted: downloads whose checksum matches
+// iRODS, bams that pass samtools quickcheck, and QC output that can be read.
+func (p *pipeline) adoptOutputs(cram *cram_file, attribute_name string) bool {
+	adopted := false
+	switch cram.Stage {
+	case stage_download:
+		// the checksums are only saved once the download has finished
+		if cram.Cram_dl_path != "" {
+			checksums, err := readChecksums(checksumsPath(cram))
+			irods_checksum, irods_err := p.irods.Checksum(cram.Irods_path)
+			local_checksum, ok := irods.MatchingChecksum(checksums, irods_checksum)
+			adopted = err == nil && irods_err == nil && ok && local_checksum == irods_checksum
+		}
+
+	case stage_align:
+		if cram.Realigned_bam_path != "" {
+			adopted = exec.Command(p.cfg.Samtools_exec, "quickcheck", cram.Realigned_bam_path).Run() == nil
+		}
+
+	case stage_index:
+		// an index older than the bam is of a previous alignment
+		if cram.Realigned_bam_path != "" {
+			bam_info, bam_err := os.Stat(cram.Realigned_bam_path)
+			bai_info, bai_err := os.Stat(cram.Realigned_bam_path + ".bai")
+			adopted = bam_err == nil && bai_err == nil && bai_info.Size() > 0 && !bai_info.ModTime().Before(bam_info.ModTime())
+		}
+
+	case stage_qc:
+		if cram.Realigned_bam_path != "" {
+			flagstat, stats, idxstats := qcPaths(cram.Realigned_bam_path)
+			_, stats_err := readSamtoolsStats(stats)
+			_, idxstats_err := readMitochondrialPercent(idxstats)
+			adopted = fileExists(flagstat) && stats_err == nil && idxstats_err == nil
+		}
+	}
+
+	if adopted {
+		log.Printf("Outputs of the lost %s job of %s are complete, using them\n", cram.Stage, cram.Filename)
+		reflect.ValueOf(cram).Elem().FieldByName(attribute_name).SetBool(true)
+	}
+	return adopted
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	report_json_filename = "report.json"
+	report_html_filename = "report.html"
+	counts_matrix_path   = "E_Counts_matrix_RNA/featurecounts_matrix.tsv"
+)
+
+// report_job is a single attempt at one of a cram's jobs. Run time and
+// maximum memory are read from the summary LSF appends to the job's output,
+// and are zero for other schedulers, for which Wall_seconds is the time from
+// submission to the job being seen to finish.
+type report_job struct {
+	Stage            string
+	Attempt          int
+	Job_id           string
+	Exit_status      int
+	Finished         bool
+	Out_of_memory    bool
+	Timed_out        bool
+	Cancelled        bool
+	Requested_memory int
+	Max_memory_mb    float64
+	Run_seconds      float64
+	Wall_seconds     float64
+	Log              string
+}
+
+type report_cram struct {
+	Run_lane            string
+	Filename            string
+	Irods_path          string
+	Sample_name         string
+	Library_type        string
+	Stage               string
+	Failed_stage        string
+	Stages              map[string]string
+	Checksum_verified   bool
+	Bam                 string
+	Quickcheck_success  bool
+	Index_success       bool
+	Qc_metrics          *qc_metrics
+	Qc_flags            []string
+	Uploaded_irods_path string
+	Removed_files       []string
+	Merge_missing       []string
+	Jobs                []report_job
+}
+
+type counts_sample struct {
+	Bam               string
+	Assigned          int
+	Total             int
+	Assigned_fraction float64
+}
+
+// counts_summary describes the counts matrix, from the matrix itself and the
+// summary featureCounts writes alongside it
+type counts_summary struct {
+	Matrix  string
+	Genes   int
+	Samples []counts_sample
+}
+
+type run_report struct {
+	Generated time.Time
+	Stages    []string
+	Totals    map[string]*library_totals
+	Crams     []report_cram
+	Counts    *counts_summary
+}
+
+var lsf_run_time_regex = regexp.MustCompile(`Run time :\s+([0-9.]+) sec`)
+var lsf_max_memory_regex = regexp.MustCompile(`Max Memory :\s+([0-9.]+) (KB|MB|GB)`)
+
+// lsfUsage reads the run time and maximum memory from the resource usage
+// summary LSF appends to a job's output file, returning zero for either it
+// can't find.
+func lsfUsage(stdout_path string) (float64, float64) {
+	dat, err := ioutil.ReadFile(stdout_path)
+	if err != nil {
+		return 0, 0
+	}
+
+	var run_seconds, max_memory_mb float64
+	if match := lsf_run_time_regex.FindSubmatch(dat); match != nil {
+		run_seconds, _ = strconv.ParseFloat(string(match[1]), 64)
+	}
+	if match := lsf_max_memory_regex.FindSubmatch(dat); match != nil {
+		max_memory_mb, _ = strconv.ParseFloat(string(match[1]), 64)
+		switch string(match[2]) {
+		case "KB":
+			max_memory_mb /= 1024
+		case "GB":
+			max_memory_mb *= 1024
+		}
+	}
+	return run_seconds, max_memory_mb
+}
+
+// reportJobs lists every job attempt of the cram, with paths relative to
+// project_root
+func reportJobs(cram *cram_file, project_root string) []report_job {
+	var jobs []report_job
+	for _, attempt := range cram.Job_attempts {
+		run_seconds, max_memory_mb := lsfUsage(filepath.Join(project_root, attempt.Stdout))
+		job := report_job{
+			Stage:            attempt.Stage,
+			Attempt:          attempt.Attempt,
+			Job_id:           attempt.Job_id,
+			Exit_status:      attempt.Exit_status,
+			Finished:         attempt.Finished,
+			Out_of_memory:    attempt.Out_of_memory,
+			Timed_out:        attempt.Timed_out,
+			Cancelled:        attempt.Cancelled,
+			Requested_memory: attempt.Memory,
+			Max_memory_mb:    max_memory_mb,
+			Run_seconds:      run_seconds,
+			Log:              attempt.Stdout,
+		}
+		if attempt.Finished && !attempt.Ended.IsZero() {
+			job.Wall_seconds = attempt.Ended.Sub(attempt.Submitted).Seconds()
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// readCountsSummary reads the number of genes in the counts matrix, and the
+// reads featureCounts assigned for each bam from its summary. It returns nil
+// if there is no counts matrix.
+func readCountsSummary(project_root string) (*counts_summary, error) {
+	matrix_path := filepath.Join(project_root, counts_matrix_path)
+	matrix, err := os.Open(matrix_path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer matrix.Close()
+
+	summary := &counts_summary{Matrix: counts_matrix_path}
+	header_seen := false
+	scanner := bufio.NewScanner(matrix)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// the first line that isn't a comment is the column names
+		if !header_seen {
+			header_seen = true
+			continue
+		}
+		summary.Genes++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	dat, err := ioutil.ReadFile(matrix_path + ".summary")
+	if os.IsNotExist(err) {
+		return summary, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(dat)), "\n")
+	bams := strings.Split(lines[0], "\t")[1:]
+	summary.Samples = make([]counts_sample, len(bams))
+	for i, bam := range bams {
+		summary.Samples[i].Bam = bam
+	}
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		for i := range bams {
+			if i+1 >= len(fields) {
+				break
+			}
+			reads, err := strconv.Atoi(fields[i+1])
+			if err != nil {
+				continue
+			}
+			summary.Samples[i].Total += reads
+			if fields[0] == "Assigned" {
+				summary.Samples[i].Assigned = reads
+			}
+		}
+	}
+	for i := range summary.Samples {
+		if summary.Samples[i].Total > 0 {
+			summary.Samples[i].Assigned_fraction = float64(summary.Samples[i].Assigned) / float64(summary.Samples[i].Total)
+		}
+	}
+	return summary, nil
+}
+
+// buildReport gathers the report of a project from its checkpoints, job logs
+// and counts matrix
+func buildReport(project_root string) (*run_report, error) {
+	run_lanes, err := readProjectCheckpoints(project_root)
+	if err != nil {
+		return nil, err
+	}
+	primaries := mergePrimaries(run_lanes)
+
+	report := &run_report{
+		Generated: time.Now(),
+		Stages:    cram_stages,
+		Totals:    make(map[string]*library_totals),
+	}
+	for _, run_lane := range run_lanes {
+		for i := range run_lane.Crams {
+			cram := &run_lane.Crams[i]
+			primary := primaries[cram.Merged_into]
+			report.Crams = append(report.Crams, report_cram{
+				Run_lane:            run_lane.Run_lane,
+				Filename:            cram.Filename,
+				Irods_path:          cram.Irods_path,
+				Sample_name:         cram.Sample_name,
+				Library_type:        cram.Library_type,
+				Stage:               cram.Stage,
+				Failed_stage:        cram.Failed_stage,
+				Stages:              stageStatuses(cram, primary),
+				Checksum_verified:   cram.Checksum_verified,
+				Bam:                 cram.Realigned_bam_path,
+				Quickcheck_success:  cram.Realigned_quickcheck_success,
+				Index_success:       cram.Realigned_index_success,
+				Qc_metrics:          cram.Qc_metrics,
+				Qc_flags:            cram.Qc_flags,
+				Uploaded_irods_path: cram.Upload_irods_path,
+				Removed_files:       cram.Removed_files,
+				Merge_missing:       cram.Merge_missing,
+				Jobs:                reportJobs(cram, project_root),
+			})
+			addToTotals(report.Totals, cram, primary)
+		}
+	}
+
+	report.Counts, err = readCountsSummary(project_root)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read counts matrix: %s", err.Error())
+	}
+	return report, nil
+}
+
+var report_template = template.Must(template.New("report").Funcs(template.FuncMap{
+	"fraction": func(fraction float64) string { return fmt.Sprintf("%.1f%%", fraction*100) },
+	"percent":  func(percent float64) string { return fmt.Sprintf("%.1f%%", percent) },
+	"seconds": func(seconds float64) string {
+		if seconds == 0 {
+			return ""
+		}
+		return (time.Duration(seconds) * time.Second).String()
+	},
+	"megabytes": func(mb float64) string {
+		if mb == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%.0f MB", mb)
+	},
+	"stage": func(stages map[string]string, stage string) string { return stages[stage] },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>iRODS-Downloader report</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 3px 8px; text-align: left; }
+th { background: #eee; }
+td.done, td.streamed, td.merged { background: #d9f2d9; }
+td.failed, td.flagged { background: #f7d4d4; }
+td.running, td.pending { background: #fff3c4; }
+td.skipped { color: #888; }
+</style>
+</head>
+<body>
+<h1>iRODS-Downloader report</h1>
+<p>Generated {{.Generated.Format "2006-01-02 15:04:05"}}</p>
+
+<h2>Summary</h2>
+<table>
+<tr><th>Library type</th><th>Done</th><th>Failed</th><th>In progress</th><th>Skipped</th></tr>
+{{range $library_type, $totals := .Totals}}<tr><td>{{$library_type}}</td><td>{{$totals.Done}}</td><td>{{$totals.Failed}}</td><td>{{$totals.In_progress}}</td><td>{{$totals.Skipped}}</td></tr>
+{{end}}</table>
+
+<h2>Counts matrix</h2>
+{{with .Counts}}<p>{{.Matrix}}: {{.Genes}} genes, {{len .Samples}} bams</p>
+{{if .Samples}}<table>
+<tr><th>Bam</th><th>Assigned reads</th><th>Total reads</th><th>Assigned</th></tr>
+{{range .Samples}}<tr><td>{{.Bam}}</td><td>{{.Assigned}}</td><td>{{.Total}}</td><td>{{fraction .Assigned_fraction}}</td></tr>
+{{end}}</table>{{end}}
+{{else}}<p>No counts matrix has been built.</p>
+{{end}}
+<h2>CRAMs</h2>
+<table>
+<tr><th>Run/lane</th><th>Filename</th><th>Sample</th><th>Library type</th>{{range .Stages}}<th>{{.}}</th>{{end}}<th>Bam</th><th>Merged without</th></tr>
+{{range $cram := .Crams}}<tr><td>{{.Run_lane}}</td><td>{{.Filename}}</td><td>{{.Sample_name}}</td><td>{{.Library_type}}</td>{{range $.Stages}}{{$status := stage $cram.Stages .}}<td class="{{$status}}">{{$status}}</td>{{end}}<td>{{.Bam}}</td><td{{if .Merge_missing}} class="flagged"{{end}}>{{range $i, $missing := .Merge_missing}}{{if $i}}; {{end}}{{$missing}}{{end}}</td></tr>
+{{end}}</table>
+
+<h2>Alignment QC</h2>
+<table>
+<tr><th>Filename</th><th>Sample</th><th>Total reads</th><th>Mapped</th><th>Duplicates</th><th>Properly paired</th><th>Mitochondrial</th><th>STAR uniquely mapped</th><th>STAR multi-mapped</th><th>Flags</th></tr>
+{{range .Crams}}{{if .Qc_metrics}}<tr><td>{{.Filename}}</td><td>{{.Sample_name}}</td>{{with .Qc_metrics}}<td>{{.Total_reads}}</td><td>{{percent .Mapping_percent}}</td><td>{{percent .Duplicate_percent}}</td><td>{{percent .Properly_paired_percent}}</td><td>{{percent .Mitochondrial_percent}}</td>{{if .Star}}<td>{{percent .Star.Uniquely_mapped_percent}}</td><td>{{percent .Star.Multi_mapped_percent}}</td>{{else}}<td></td><td></td>{{end}}{{end}}<td{{if .Qc_flags}} class="flagged"{{end}}>{{range $i, $flag := .Qc_flags}}{{if $i}}; {{end}}{{$flag}}{{end}}</td></tr>
+{{end}}{{end}}</table>
+
+<h2>Jobs</h2>
+<table>
+<tr><th>Filename</th><th>Stage</th><th>Attempt</th><th>Job id</th><th>Exit status</th><th>Run time</th><th>Wall time</th><th>Max memory</th><th>Requested memory</th><th>Log</th></tr>
+{{range .Crams}}{{$filename := .Filename}}{{range .Jobs}}<tr><td>{{$filename}}</td><td>{{.Stage}}</td><td>{{.Attempt}}</td><td>{{.Job_id}}</td><td{{if and .Finished (ne .Exit_status 0)}} class="failed"{{end}}>{{if .Finished}}{{.Exit_status}}{{if .Out_of_memory}} (out of memory){{end}}{{if .Timed_out}} (timed out){{end}}{{if .Cancelled}} (cancelled){{end}}{{else}}running{{end}}</td><td>{{seconds .Run_seconds}}</td><td>{{seconds .Wall_seconds}}</td><td>{{megabytes .Max_memory_mb}}</td><td>{{.Requested_memory}} MB</td><td>{{.Log}}</td></tr>
+{{end}}{{end}}</table>
+</body>
+</html>
+`))
+
+// writeReport writes the project's report to report.json and report.html in
+// the project root, the html being a single file with no external resources
+// so that it can be passed on as it is.
+func writeReport(project_root string) error {
+	report, err := buildReport(project_root)
+	if err != nil {
+		return err
+	}
+
+	report_json, _ := json.MarshalIndent(report, "", "  ")
+	err = ioutil.WriteFile(filepath.Join(project_root, report_json_filename), report_json, 0644)
+	if err != nil {
+		return err
+	}
+
+	html_file, err := os.Create(filepath.Join(project_root, report_html_filename))
+	if err != nil {
+		return err
+	}
+	defer html_file.Close()
+	return report_template.Execute(html_file, report)
+}
+
+// reportCommand implements "irods_downloader report", writing the report of a
+// project from its checkpoints, as is done at the end of every run.
+func reportCommand(args []string) {
+	var project_root string
+
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	flags.StringVar(&project_root, "p", ".", "Specify the project root directory")
+	flags.Parse(args)
+
+	if err := writeReport(project_root); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("Report written to %s and %s\n",
+		filepath.Join(project_root, report_html_filename), filepath.Join(project_root, report_json_filename))
+}
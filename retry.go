@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// job_attempt records a single submission of a cram's job, so that the
+// history of retries is kept in the checkpoint. Attempts cancelled when
+// irods_downloader was interrupted aren't counted as failures.
+type job_attempt struct {
+	Stage         string
+	Attempt       int
+	Job_id        string
+	Memory        int
+	Stdout        string
+	Stderr        string
+	Submitted     time.Time
+	Ended         time.Time
+	Finished      bool
+	Exit_status   int
+	Out_of_memory bool
+	Timed_out     bool
+	Cancelled     bool
+}
+
+// stages with jobs that can be given a timeout, besides those of each cram
+var project_job_stages = []string{"featurecounts", "counts_upload"}
+
+// jobTimeoutsFromConfig reads job_timeouts, which gives the longest a job of
+// each stage may take from being submitted, as durations such as "12h". A
+// timeout given as "default" applies to every stage not given its own.
+func jobTimeoutsFromConfig() (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	for stage, value := range viper.GetStringMapString("job_timeouts") {
+		if stage != "default" && !stringInSlice(stage, cram_stages) && !stringInSlice(stage, project_job_stages) {
+			return nil, fmt.Errorf("job_timeouts gives a timeout for unknown stage '%s'", stage)
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read job timeout of %s: %s", stage, err.Error())
+		}
+		timeouts[stage] = timeout
+	}
+	return timeouts, nil
+}
+
+// jobTimeout returns the timeout of the stage's jobs, which is 0 if they
+// don't have one
+func (p *pipeline) jobTimeout(stage string) time.Duration {
+	if timeout, ok := p.cfg.Job_timeouts[stage]; ok {
+		return timeout
+	}
+	return p.cfg.Job_timeouts["default"]
+}
+
+// jobTimedOut reports whether the cram's current job has taken longer than
+// the timeout of its stage, in which case it is cancelled.
+func (p *pipeline) jobTimedOut(cram *cram_file) bool {
+	timeout := p.jobTimeout(cram.Stage)
+	if timeout <= 0 {
+		return false
+	}
+	for i := range cram.Job_attempts {
+		attempt := &cram.Job_attempts[i]
+		if attempt.Job_id != cram.Job_id || attempt.Stage != cram.Stage || attempt.Finished {
+			continue
+		}
+		if time.Since(attempt.Submitted) < timeout {
+			return false
+		}
+		log.Printf("Job %s for %s has not finished within %s, cancelling it\n", cram.Job_id, cram.Filename, timeout)
+		if err := p.sched.Cancel(cram.Job_id); err != nil {
+			log.Println(err)
+		}
+		attempt.Timed_out = true
+		return true
+	}
+	return false
+}
+
+// stageAttempts returns the attempts made at the cram's current stage
+func stageAttempts(cram *cram_file) []*job_attempt {
+	var attempts []*job_attempt
+	for i := range cram.Job_attempts {
+		if cram.Job_attempts[i].Stage == cram.Stage {
+			attempts = append(attempts, &cram.Job_attempts[i])
+		}
+	}
+	return attempts
+}
+
+// attemptLogPath adds the attempt number to the log files of retried jobs so
+// that the logs of every attempt are kept.
+func attemptLogPath(path string, attempt int) string {
+	if attempt <= 1 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + ".attempt" + strconv.Itoa(attempt) + ext
+}
+
+// prepareAttempt updates the job for the next attempt at the cram's current
+// stage and adds it to the cram's attempt history. If the previous attempt ran
+// out of memory, the memory requested is escalated.
+func (p *pipeline) prepareAttempt(cram *cram_file, job *job_spec) *job_attempt {
+	attempts := stageAttempts(cram)
+	attempt_number := len(attempts) + 1
+
+	if len(attempts) > 0 {
+		last := attempts[len(attempts)-1]
+		if last.Memory > job.Memory {
+			job.Memory = last.Memory
+		}
+		if last.Out_of_memory && p.cfg.Job_memory_escalation > 1 {
+			job.Memory = int(math.Ceil(float64(job.Memory) * p.cfg.Job_memory_escalation))
+			log.Printf("Escalating memory of %s to %dMB after it ran out of memory\n", job.Name, job.Memory)
+		}
+	}
+
+	job.Stdout = attemptLogPath(job.Stdout, attempt_number)
+	job.Stderr = attemptLogPath(job.Stderr, attempt_number)
+
+	cram.Job_attempts = append(cram.Job_attempts, job_attempt{
+		Stage:     cram.Stage,
+		Attempt:   attempt_number,
+		Memory:    job.Memory,
+		Stdout:    job.Stdout,
+		Stderr:    job.Stderr,
+		Submitted: time.Now(),
+	})
+	return &cram.Job_attempts[len(cram.Job_attempts)-1]
+}
+
+// recordAttempt saves the outcome of the cram's current job in its attempt
+// history.
+func (p *pipeline) recordAttempt(cram *cram_file, exit_status int) {
+	for i := range cram.Job_attempts {
+		attempt := &cram.Job_attempts[i]
+		if attempt.Job_id == cram.Job_id && attempt.Stage == cram.Stage && !attempt.Finished {
+			attempt.Finished = true
+			attempt.Ended = time.Now()
+			attempt.Exit_status = exit_status
+			out_of_memory, err := p.sched.OutOfMemory(cram.Job_id)
+			if err == nil {
+				attempt.Out_of_memory = out_of_memory
+			}
+		}
+	}
+}
+
+// the most times the back-off between attempts is doubled, so that a long run
+// of failures doesn't overflow it
+const max_backoff_doublings = 10
+
+// retryBackoff is the wait before the attempt after failed_attempts failed
+// ones, doubling backoff with each failure after the first
+func retryBackoff(backoff time.Duration, failed_attempts int) time.Duration {
+	doublings := failed_attempts - 1
+	if doublings < 0 {
+		doublings = 0
+	}
+	if doublings > max_backoff_doublings {
+		doublings = max_backoff_doublings
+	}
+	return backoff * time.Duration(1<<uint(doublings))
+}
+
+// retryJob schedules the cram's current stage to be submitted again after the
+// back-off, which doubles with each attempt. It returns false once the
+// maximum number of attempts has been reached.
+func (p *pipeline) retryJob(cram *cram_file) bool {
+	failed_attempts := 0
+	for _, attempt := range stageAttempts(cram) {
+		if attempt.Finished && !attempt.Cancelled {
+			failed_attempts++
+		}
+	}
+	if failed_attempts >= p.cfg.Job_max_attempts {
+		return false
+	}
+
+	backoff := retryBackoff(p.cfg.Job_retry_backoff, failed_attempts)
+	log.Printf("Retrying stage %s of %s in %s (attempt %d of %d failed)\n",
+		cram.Stage, cram.Filename, backoff, failed_attempts, p.cfg.Job_max_attempts)
+	cram.Job_id = ""
+	cram.Retry_after = time.Now().Add(backoff)
+	return true
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		failed_attempts int
+		want            time.Duration
+	}{
+		{-1, time.Minute},
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{11, 1024 * time.Minute},
+		{100, 1024 * time.Minute},
+	}
+	for _, test := range tests {
+		if got := retryBackoff(time.Minute, test.failed_attempts); got != test.want {
+			t.Errorf("retryBackoff after %d failed attempts = %s, want %s", test.failed_attempts, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/seanlaidlaw/iRODS-Downloader/irods"
+)
+
+// run_lane is a single sequencing run and lane pair requested by the user.
+// Each pair's outputs and checkpoint are kept in their own directory under
+// the project root so that pairs can progress and fail independently. Pairs
+// found through a metadata selection hold the data objects that were selected,
+// as only those crams of the lane are processed.
+type run_lane struct {
+	Run  string
+	Lane string
+
+	crams    []cram_file
+	selected []irods.Data_object
+	failed   bool
+}
+
+func (rl *run_lane) String() string {
+	return fmt.Sprintf("run %s lane %s", rl.Run, rl.Lane)
+}
+
+func (rl *run_lane) dir() string {
+	return rl.Run + "_" + rl.Lane
+}
+
+func (rl *run_lane) checkpointPath() string {
+	return rl.dir() + "/checkpoint.json"
+}
+
+// fail marks the run/lane as failed so that it is left out of all further
+// steps, without stopping the other run/lanes.
+func (rl *run_lane) fail(err error) {
+	log.Printf("Stopping %s: %s\n", rl, err.Error())
+	rl.failed = true
+}
+
+func (rl *run_lane) loadCheckpoint() error {
+	crams, err := readCheckpoint(rl.checkpointPath())
+	if err != nil {
+		return err
+	}
+	rl.crams = crams
+	return nil
+}
+
+func (rl *run_lane) writeCheckpoint() {
+	writeCheckpoint(rl.checkpointPath(), rl.crams)
+}
+
+// cramsOf returns pointers to the crams of each of the given run/lanes so
+// that steps can update them in place.
+func cramsOf(run_lanes []*run_lane) []*cram_file {
+	var crams []*cram_file
+	for _, rl := range run_lanes {
+		for i := range rl.crams {
+			crams = append(crams, &rl.crams[i])
+		}
+	}
+	return crams
+}
+
+// string_list_flag is a flag.Value that collects every use of a repeated flag
+type string_list_flag []string
+
+func (f *string_list_flag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *string_list_flag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// expandLanes turns a lane specification such as "1", "1-8" or "1,3,5-6" into
+// the list of lanes it refers to.
+func expandLanes(spec string) ([]string, error) {
+	var lanes []string
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "-") {
+			if _, err := strconv.Atoi(part); err != nil {
+				return nil, fmt.Errorf("invalid lane '%s'", part)
+			}
+			lanes = append(lanes, part)
+			continue
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+		start, err_start := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		end, err_end := strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err_start != nil || err_end != nil || start > end {
+			return nil, fmt.Errorf("invalid lane range '%s'", part)
+		}
+		for lane := start; lane <= end; lane++ {
+			lanes = append(lanes, strconv.Itoa(lane))
+		}
+	}
+	if len(lanes) == 0 {
+		return nil, fmt.Errorf("no lanes given in '%s'", spec)
+	}
+	return lanes, nil
+}
+
+// runLanesFromFlags pairs up the -r and -l flags. Either each run is given
+// with its own lane specification, or a single run is given with any number
+// of lane specifications. A run given without any lanes is an error, rather
+// than silently selecting nothing.
+func runLanesFromFlags(runs []string, lanes []string) ([]*run_lane, error) {
+	if len(runs) > 0 && len(lanes) == 0 {
+		return nil, fmt.Errorf("no lanes given for run %s, give its lanes with -l", strings.Join(runs, ", "))
+	}
+	if len(runs) != len(lanes) && len(runs) != 1 {
+		return nil, fmt.Errorf("got %d runs and %d lanes, either give one lane per run or a single run", len(runs), len(lanes))
+	}
+
+	var run_lanes []*run_lane
+	for i, lane_spec := range lanes {
+		run := runs[0]
+		if len(runs) > 1 {
+			run = runs[i]
+		}
+		expanded, err := expandLanes(lane_spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, lane := range expanded {
+			run_lanes = append(run_lanes, &run_lane{Run: strings.TrimSpace(run), Lane: lane})
+		}
+	}
+	return run_lanes, nil
+}
+
+// readManifest reads run/lane pairs from a file with one whitespace separated
+// run and lane specification per line. Blank lines and lines starting with
+// '#' are ignored.
+func readManifest(manifest_path string) ([]*run_lane, error) {
+	manifest, err := os.Open(manifest_path)
+	if err != nil {
+		return nil, err
+	}
+	defer manifest.Close()
+
+	var run_lanes []*run_lane
+	scanner := bufio.NewScanner(manifest)
+	line_number := 0
+	for scanner.Scan() {
+		line_number++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected a run and a lane, got '%s'", manifest_path, line_number, line)
+		}
+		lanes, err := expandLanes(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", manifest_path, line_number, err.Error())
+		}
+		for _, lane := range lanes {
+			run_lanes = append(run_lanes, &run_lane{Run: fields[0], Lane: lane})
+		}
+	}
+	return run_lanes, scanner.Err()
+}
+
+// uniqueRunLanes removes repeated run/lane pairs, keeping the first occurrence
+func uniqueRunLanes(run_lanes []*run_lane) []*run_lane {
+	seen := make(map[string]bool)
+	var unique []*run_lane
+	for _, rl := range run_lanes {
+		if !seen[rl.dir()] {
+			seen[rl.dir()] = true
+			unique = append(unique, rl)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandLanes(t *testing.T) {
+	tests := []struct {
+		spec  string
+		want  []string
+		fails bool
+	}{
+		{"1", []string{"1"}, false},
+		{"1-4", []string{"1", "2", "3", "4"}, false},
+		{"1,3,5-6", []string{"1", "3", "5", "6"}, false},
+		{" 2 , 7 - 8 ,", []string{"2", "7", "8"}, false},
+		{"3-3", []string{"3"}, false},
+		{"4-2", nil, true},
+		{"a", nil, true},
+		{"1-b", nil, true},
+		{"", nil, true},
+		{",", nil, true},
+	}
+	for _, test := range tests {
+		got, err := expandLanes(test.spec)
+		if !reflect.DeepEqual(got, test.want) || (err != nil) != test.fails {
+			t.Errorf("expandLanes(%q) = %v, %v, want %v", test.spec, got, err, test.want)
+		}
+	}
+}
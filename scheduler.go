@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// job_spec describes a single command that a scheduler should run, along with
+// where its output should be written and the resources it requires. Jobs made
+// of several commands run a script, which is written to Script_path before the
+// job is submitted.
+type job_spec struct {
+	Name        string
+	Stdout      string
+	Stderr      string
+	Memory      int // in MB
+	Threads     int
+	Command     []string
+	Script      string
+	Script_path string
+}
+
+// job_state is the state of a job as reported by its scheduler. A job is lost
+// when the scheduler has no record of it, or it will never report back, such
+// as when it was killed while its host was unreachable.
+type job_state int
+
+const (
+	job_pending job_state = iota
+	job_running
+	job_finished
+	job_lost
+)
+
+// scheduler is implemented by each of the backends that jobs can be run
+// through. Submit returns a job id which is then used to track the job, and
+// SubmitCommand the command line Submit runs, for printing in dry runs.
+// Commands lists the executables the backend needs, which are checked before
+// any jobs are submitted. Detachable reports whether jobs keep running once
+// irods_downloader exits, so that a later run can reattach to them.
+type scheduler interface {
+	Commands() []string
+	Detachable() bool
+	SubmitCommand(job job_spec) []string
+	Submit(job job_spec) (string, error)
+	Poll(job_id string) (job_state, error)
+	Cancel(job_id string) error
+	ExitStatus(job_id string) (int, error)
+	OutOfMemory(job_id string) (bool, error)
+}
+
+// newScheduler returns the scheduler backend matching the name given in the
+// config file, either "lsf", "slurm" or "local".
+func newScheduler(name string, queue string, local_max_jobs int) (scheduler, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "lsf":
+		return newLsfScheduler(queue), nil
+	case "slurm":
+		return newSlurmScheduler(queue), nil
+	case "local":
+		return newLocalScheduler(local_max_jobs), nil
+	}
+	return nil, fmt.Errorf("unknown scheduler '%s', expected one of lsf, slurm or local", name)
+}
+
+// scriptJob sets the job to run a bash script of the given lines, which stops
+// at the first command that fails, including any command within a pipeline.
+func scriptJob(job job_spec, script_path string, lines []string) job_spec {
+	job.Script = "#!/bin/bash\nset -euo pipefail\n" + strings.Join(lines, "\n") + "\n"
+	job.Script_path = script_path
+	job.Command = []string{"/bin/bash", script_path}
+	return job
+}
+
+// writeJobScript writes the job's script, if it has one, so it can be submitted
+func writeJobScript(job job_spec) error {
+	if job.Script == "" {
+		return nil
+	}
+	return ioutil.WriteFile(job.Script_path, []byte(job.Script), 0755)
+}
+
+var shell_safe_regex = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote joins the arguments of a command into a single string that can
+// be safely interpreted by sh, for schedulers that only accept a command line.
+// Only arguments containing characters special to the shell are quoted, so
+// that the commands printed in dry runs stay readable.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if shell_safe_regex.MatchString(arg) {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
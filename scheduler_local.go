@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// local_jobs_dir is where the process group of each running local job is
+// recorded, relative to the project root, so that jobs left running by a run
+// that was killed can be killed by the next
+const local_jobs_dir = "local_jobs"
+
+// local_scheduler runs jobs as child processes on the current machine, with at
+// most max_jobs of them running at the same time. Job ids start with the pid
+// of irods_downloader, so that they are unique across runs.
+type local_scheduler struct {
+	slots chan struct{}
+
+	mu      sync.Mutex
+	jobs    map[string]*local_job
+	next_id int
+}
+
+type local_job struct {
+	state       job_state
+	exit_status int
+	cancelled   bool
+	cmd         *exec.Cmd
+}
+
+// local_job_record is the process group of a running local job, and the
+// command it runs so that a process reusing its pid isn't mistaken for it
+type local_job_record struct {
+	Process_group int
+	Command       []string
+}
+
+func newLocalScheduler(max_jobs int) *local_scheduler {
+	if max_jobs < 1 {
+		max_jobs = 1
+	}
+	return &local_scheduler{
+		slots: make(chan struct{}, max_jobs),
+		jobs:  make(map[string]*local_job),
+	}
+}
+
+// Detachable is false, as jobs are child processes that can't be reattached to
+func (s *local_scheduler) Detachable() bool {
+	return false
+}
+
+// Commands is empty, as jobs are run directly
+func (s *local_scheduler) Commands() []string {
+	return nil
+}
+
+// SubmitCommand returns the job's own command, as it is run directly
+func (s *local_scheduler) SubmitCommand(job job_spec) []string {
+	return job.Command
+}
+
+func (s *local_scheduler) Submit(job job_spec) (string, error) {
+	if len(job.Command) == 0 {
+		return "", fmt.Errorf("no command given for job %s", job.Name)
+	}
+
+	s.mu.Lock()
+	s.next_id++
+	job_id := fmt.Sprintf("%d.%d", os.Getpid(), s.next_id)
+	local := &local_job{state: job_pending}
+	s.jobs[job_id] = local
+	s.mu.Unlock()
+
+	go s.run(job_id, job, local)
+
+	return job_id, nil
+}
+
+// run waits for a free slot and then runs the job's command, writing its
+// stdout and stderr to the files given in the job_spec.
+func (s *local_scheduler) run(job_id string, job job_spec, local *local_job) {
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+
+	s.mu.Lock()
+	if local.cancelled {
+		s.mu.Unlock()
+		return
+	}
+
+	exit_status := -1
+	stdout, err := os.Create(job.Stdout)
+	if err == nil {
+		defer stdout.Close()
+		var stderr *os.File
+		stderr, err = os.Create(job.Stderr)
+		if err == nil {
+			defer stderr.Close()
+			local.cmd = exec.Command(job.Command[0], job.Command[1:]...)
+			local.cmd.Stdout = stdout
+			local.cmd.Stderr = stderr
+			// in its own process group, so that cancelling the job also kills
+			// the commands its script runs
+			local.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			err = local.cmd.Start()
+		}
+	}
+	if err != nil {
+		local.state = job_finished
+		local.exit_status = exit_status
+		s.mu.Unlock()
+		return
+	}
+	local.state = job_running
+	s.mu.Unlock()
+
+	record_path := filepath.Join(local_jobs_dir, job_id+".json")
+	record, _ := json.Marshal(local_job_record{Process_group: local.cmd.Process.Pid, Command: job.Command})
+	if err := os.MkdirAll(local_jobs_dir, 0755); err == nil {
+		ioutil.WriteFile(record_path, record, 0644)
+	}
+	defer os.Remove(record_path)
+
+	err = local.cmd.Wait()
+	if err == nil {
+		exit_status = 0
+	} else if exit_err, ok := err.(*exec.ExitError); ok {
+		exit_status = exit_err.ExitCode()
+	}
+
+	s.mu.Lock()
+	local.state = job_finished
+	local.exit_status = exit_status
+	s.mu.Unlock()
+}
+
+func (s *local_scheduler) job(job_id string) (*local_job, error) {
+	local, ok := s.jobs[job_id]
+	if !ok {
+		return nil, fmt.Errorf("unknown local job %s", job_id)
+	}
+	return local, nil
+}
+
+func (s *local_scheduler) Poll(job_id string) (job_state, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	local, err := s.job(job_id)
+	if err != nil {
+		// started by a previous invocation, so no longer running
+		return job_lost, nil
+	}
+	return local.state, nil
+}
+
+func (s *local_scheduler) Cancel(job_id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	local, err := s.job(job_id)
+	if err != nil {
+		return cancelPreviousLocalJob(job_id)
+	}
+	if local.state == job_pending {
+		local.cancelled = true
+		local.state = job_finished
+		local.exit_status = -1
+		return nil
+	}
+	if local.state == job_running {
+		return syscall.Kill(-local.cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return nil
+}
+
+// cancelPreviousLocalJob kills the process group of a job started by a run
+// that stopped without cancelling it, as the job's commands keep running once
+// irods_downloader has exited. The group is left alone if its pid has since
+// been taken by another command.
+func cancelPreviousLocalJob(job_id string) error {
+	record_path := filepath.Join(local_jobs_dir, job_id+".json")
+	dat, err := ioutil.ReadFile(record_path)
+	if os.IsNotExist(err) {
+		// never started, or has finished
+		return nil
+	}
+	var record local_job_record
+	if err == nil {
+		err = json.Unmarshal(dat, &record)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read local job %s: %s", job_id, err.Error())
+	}
+	defer os.Remove(record_path)
+
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", record.Process_group))
+	if err == nil && string(bytes.TrimRight(cmdline, "\x00")) != strings.Join(record.Command, "\x00") {
+		return nil
+	}
+	err = syscall.Kill(-record.Process_group, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
+
+func (s *local_scheduler) ExitStatus(job_id string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	local, err := s.job(job_id)
+	if err != nil {
+		return -1, err
+	}
+	if local.state != job_finished {
+		return -1, fmt.Errorf("local job %s has not finished", job_id)
+	}
+	return local.exit_status, nil
+}
+
+// OutOfMemory always reports false, as local jobs aren't given a memory limit
+func (s *local_scheduler) OutOfMemory(job_id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.job(job_id)
+	return false, err
+}
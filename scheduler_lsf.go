@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var bsub_job_id_regex = regexp.MustCompile(`Job <(\d+)> is submitted`)
+var lsf_exit_code_regex = regexp.MustCompile(`Exited with exit code (\d+)`)
+
+// bhist wraps its long output at 80 columns, indenting continuation lines
+var bhist_wrap_regex = regexp.MustCompile(`\n {21}`)
+
+// lsf_scheduler submits jobs with bsub and checks on them with bjobs. Jobs
+// that bjobs no longer knows about, as they finished longer ago than LSF's
+// CLEAN_PERIOD, are looked up with bhist, and failing that in the report LSF
+// appends to each job's output file. A job none of these know about is lost.
+type lsf_scheduler struct {
+	queue string
+
+	mu          sync.Mutex
+	job_outputs map[string]string
+	finished    map[string]lsf_job_status
+}
+
+// lsf_job_status is what LSF reports about a job
+type lsf_job_status struct {
+	state         job_state
+	exit_status   int
+	out_of_memory bool
+}
+
+// bjobs_output is the output of bjobs -json. Jobs bjobs doesn't know about
+// have an ERROR rather than the requested fields.
+type bjobs_output struct {
+	Records []struct {
+		Jobid       string `json:"JOBID"`
+		Stat        string `json:"STAT"`
+		Exit_code   string `json:"EXIT_CODE"`
+		Exit_reason string `json:"EXIT_REASON"`
+		Error       string `json:"ERROR"`
+	} `json:"RECORDS"`
+}
+
+func newLsfScheduler(queue string) *lsf_scheduler {
+	return &lsf_scheduler{
+		queue:       queue,
+		job_outputs: make(map[string]string),
+		finished:    make(map[string]lsf_job_status),
+	}
+}
+
+func (s *lsf_scheduler) Detachable() bool {
+	return true
+}
+
+func (s *lsf_scheduler) Commands() []string {
+	return []string{"bsub", "bjobs", "bhist", "bkill"}
+}
+
+// SubmitCommand returns the bsub command line that submits the job
+func (s *lsf_scheduler) SubmitCommand(job job_spec) []string {
+	args := []string{"bsub", "-o", job.Stdout, "-e", job.Stderr}
+	if job.Name != "" {
+		args = append(args, "-J", job.Name)
+	}
+	if job.Memory > 0 {
+		mem := strconv.Itoa(job.Memory)
+		args = append(args, "-R", "select[mem>"+mem+"] rusage[mem="+mem+"]", "-M"+mem)
+	}
+	if job.Threads > 1 {
+		args = append(args, "-n", strconv.Itoa(job.Threads))
+	}
+	if s.queue != "" {
+		args = append(args, "-q", s.queue)
+	}
+	return append(args, job.Command...)
+}
+
+func (s *lsf_scheduler) Submit(job job_spec) (string, error) {
+	args := s.SubmitCommand(job)
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("bsub failed: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	match := bsub_job_id_regex.FindSubmatch(output)
+	if match == nil {
+		return "", fmt.Errorf("unable to find job id in bsub output: %s", strings.TrimSpace(string(output)))
+	}
+	job_id := string(match[1])
+
+	s.mu.Lock()
+	s.job_outputs[job_id] = job.Stdout
+	s.mu.Unlock()
+
+	return job_id, nil
+}
+
+// status returns the state of the job, and its exit status once it has
+// finished. The status of finished jobs is kept, so that checking their exit
+// status and memory doesn't query LSF again.
+func (s *lsf_scheduler) status(job_id string) (lsf_job_status, error) {
+	s.mu.Lock()
+	status, ok := s.finished[job_id]
+	s.mu.Unlock()
+	if ok {
+		return status, nil
+	}
+
+	status, known, err := bjobsStatus(job_id)
+	if err == nil && !known {
+		status, known, err = bhistStatus(job_id)
+	}
+	if err == nil && !known {
+		status, known = s.reportStatus(job_id)
+	}
+	if err != nil {
+		return lsf_job_status{state: job_pending, exit_status: -1}, err
+	}
+	if !known {
+		status = lsf_job_status{state: job_lost, exit_status: -1}
+	}
+
+	if status.state == job_finished {
+		s.mu.Lock()
+		s.finished[job_id] = status
+		s.mu.Unlock()
+	}
+	return status, nil
+}
+
+// bjobsStatus asks bjobs for the state of the job, returning false if bjobs
+// doesn't know about it
+func bjobsStatus(job_id string) (lsf_job_status, bool, error) {
+	status := lsf_job_status{exit_status: -1}
+	// bjobs exits with a non-zero status for jobs it doesn't know about, so
+	// the output is parsed whatever the exit status
+	output, err := exec.Command(
+		"bjobs", "-json", "-o", "jobid stat exit_code exit_reason", job_id).Output()
+	var parsed bjobs_output
+	if json_err := json.Unmarshal(output, &parsed); json_err != nil {
+		if err == nil {
+			err = json_err
+		}
+		return status, false, fmt.Errorf("bjobs failed: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+	if len(parsed.Records) == 0 || parsed.Records[0].Error != "" {
+		return status, false, nil
+	}
+
+	record := parsed.Records[0]
+	switch record.Stat {
+	case "PEND", "PSUSP", "WAIT":
+		status.state = job_pending
+	case "DONE":
+		status.state = job_finished
+		status.exit_status = 0
+	case "EXIT":
+		status.state = job_finished
+		if code, err := strconv.Atoi(record.Exit_code); err == nil {
+			status.exit_status = code
+		}
+		status.out_of_memory = strings.Contains(record.Exit_reason, "TERM_MEMLIMIT")
+	case "ZOMBI":
+		// killed while its host was unreachable, so will never report back
+		status.state = job_lost
+	default:
+		// RUN, the suspended states, and UNKWN while its host is unreachable
+		status.state = job_running
+	}
+	return status, true, nil
+}
+
+// bhistStatus reads the state of the job from its history, returning false if
+// bhist doesn't know about it
+func bhistStatus(job_id string) (lsf_job_status, bool, error) {
+	status := lsf_job_status{exit_status: -1}
+	output, err := exec.Command("bhist", "-l", job_id).CombinedOutput()
+	history := bhist_wrap_regex.ReplaceAllString(string(output), "")
+	if strings.Contains(history, "No matching job found") {
+		return status, false, nil
+	}
+	if err != nil {
+		return status, false, fmt.Errorf("bhist failed: %s: %s", err, strings.TrimSpace(history))
+	}
+
+	switch {
+	case strings.Contains(history, "Done successfully"):
+		status.state = job_finished
+		status.exit_status = 0
+	case strings.Contains(history, "Exited"):
+		status.state = job_finished
+		if match := lsf_exit_code_regex.FindStringSubmatch(history); match != nil {
+			status.exit_status, _ = strconv.Atoi(match[1])
+		}
+		status.out_of_memory = strings.Contains(history, "TERM_MEMLIMIT")
+	case strings.Contains(history, "Starting"):
+		status.state = job_running
+	default:
+		status.state = job_pending
+	}
+	return status, true, nil
+}
+
+// reportStatus reads the state of the job from the report LSF appends to its
+// output file once it has finished, returning false if there is none
+func (s *lsf_scheduler) reportStatus(job_id string) (lsf_job_status, bool) {
+	status := lsf_job_status{exit_status: -1}
+	s.mu.Lock()
+	output_filename, ok := s.job_outputs[job_id]
+	s.mu.Unlock()
+	if !ok {
+		return status, false
+	}
+	dat, err := ioutil.ReadFile(output_filename)
+	report := string(dat)
+	// job has finished (either successfully or with exit code)
+	if err != nil || !strings.Contains(report, "Terminated at") {
+		return status, false
+	}
+
+	status.state = job_finished
+	if strings.Contains(report, "Successfully completed.") {
+		status.exit_status = 0
+	} else if match := lsf_exit_code_regex.FindStringSubmatch(report); match != nil {
+		status.exit_status, _ = strconv.Atoi(match[1])
+	}
+	// otherwise killed by a signal or by LSF itself, so there is no exit code
+	status.out_of_memory = strings.Contains(report, "TERM_MEMLIMIT")
+	return status, true
+}
+
+func (s *lsf_scheduler) Poll(job_id string) (job_state, error) {
+	status, err := s.status(job_id)
+	return status.state, err
+}
+
+func (s *lsf_scheduler) Cancel(job_id string) error {
+	output, err := exec.Command("bkill", job_id).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("bkill failed: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (s *lsf_scheduler) ExitStatus(job_id string) (int, error) {
+	status, err := s.status(job_id)
+	if err != nil {
+		return -1, err
+	}
+	if status.state != job_finished && status.state != job_lost {
+		return -1, fmt.Errorf("LSF job %s has not finished", job_id)
+	}
+	return status.exit_status, nil
+}
+
+// OutOfMemory reports whether LSF killed the job for reaching its memory limit
+func (s *lsf_scheduler) OutOfMemory(job_id string) (bool, error) {
+	status, err := s.status(job_id)
+	return status.out_of_memory, err
+}
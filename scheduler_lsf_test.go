@@ -0,0 +1,101 @@
+package main
+
+import "testing"
+
+func TestBjobsStatus(t *testing.T) {
+	dir, cleanup := fakeCommandDir(t)
+	defer cleanup()
+
+	tests := []struct {
+		output string
+		want   lsf_job_status
+		known  bool
+	}{
+		{
+			`{"RECORDS":[{"JOBID":"1","STAT":"PEND","EXIT_CODE":"","EXIT_REASON":""}]}`,
+			lsf_job_status{state: job_pending, exit_status: -1}, true,
+		},
+		{
+			`{"RECORDS":[{"JOBID":"1","STAT":"RUN","EXIT_CODE":"","EXIT_REASON":""}]}`,
+			lsf_job_status{state: job_running, exit_status: -1}, true,
+		},
+		{
+			`{"RECORDS":[{"JOBID":"1","STAT":"DONE","EXIT_CODE":"","EXIT_REASON":""}]}`,
+			lsf_job_status{state: job_finished, exit_status: 0}, true,
+		},
+		{
+			`{"RECORDS":[{"JOBID":"1","STAT":"EXIT","EXIT_CODE":"2","EXIT_REASON":""}]}`,
+			lsf_job_status{state: job_finished, exit_status: 2}, true,
+		},
+		{
+			`{"RECORDS":[{"JOBID":"1","STAT":"EXIT","EXIT_CODE":"","EXIT_REASON":"TERM_MEMLIMIT: job killed after reaching LSF memory usage limit"}]}`,
+			lsf_job_status{state: job_finished, exit_status: -1, out_of_memory: true}, true,
+		},
+		{
+			`{"RECORDS":[{"JOBID":"1","STAT":"ZOMBI","EXIT_CODE":"","EXIT_REASON":""}]}`,
+			lsf_job_status{state: job_lost, exit_status: -1}, true,
+		},
+		{
+			`{"RECORDS":[{"ERROR":"Job <1> is not found"}]}`,
+			lsf_job_status{exit_status: -1}, false,
+		},
+	}
+	for _, test := range tests {
+		fakeCommand(t, dir, "bjobs", test.output, 0)
+		got, known, err := bjobsStatus("1")
+		if err != nil || got != test.want || known != test.known {
+			t.Errorf("bjobsStatus of %s = %+v, %v, %v, want %+v, %v", test.output, got, known, err, test.want, test.known)
+		}
+	}
+
+	fakeCommand(t, dir, "bjobs", "LSF is down", 255)
+	if _, _, err := bjobsStatus("1"); err == nil {
+		t.Errorf("bjobsStatus succeeded when bjobs didn't give json")
+	}
+}
+
+func TestBhistStatus(t *testing.T) {
+	dir, cleanup := fakeCommandDir(t)
+	defer cleanup()
+
+	header := "Job <1>, User <user>, Project <default>, Command <./A_iget_1234_1#1.cram.s\n" +
+		"                     h>\n"
+	tests := []struct {
+		output string
+		want   lsf_job_status
+		known  bool
+	}{
+		{header + "Mon Oct  5 10:00:00: Submitted from host <head>;\n", lsf_job_status{state: job_pending, exit_status: -1}, true},
+		{
+			header + "Mon Oct  5 10:00:00: Submitted from host <head>;\nMon Oct  5 10:01:00: Starting (Pid 42);\n",
+			lsf_job_status{state: job_running, exit_status: -1}, true,
+		},
+		{
+			header + "Mon Oct  5 10:01:00: Starting (Pid 42);\nMon Oct  5 11:00:00: Done successfully. The CPU time used is 1.0 seconds;\n",
+			lsf_job_status{state: job_finished, exit_status: 0}, true,
+		},
+		{
+			// bhist wraps the exit code onto the next line
+			header + "Mon Oct  5 10:01:00: Starting (Pid 42);\nMon Oct  5 11:00:00: Exited with exit code 1\n" +
+				"                     37. The CPU time used is 1.0 seconds;\n",
+			lsf_job_status{state: job_finished, exit_status: 137}, true,
+		},
+		{
+			header + "Mon Oct  5 11:00:00: Exited by LSF signal TERM_MEMLIMIT. The CPU time used is 1.0 seconds;\n",
+			lsf_job_status{state: job_finished, exit_status: -1, out_of_memory: true}, true,
+		},
+		{"No matching job found\n", lsf_job_status{exit_status: -1}, false},
+	}
+	for _, test := range tests {
+		fakeCommand(t, dir, "bhist", test.output, 0)
+		got, known, err := bhistStatus("1")
+		if err != nil || got != test.want || known != test.known {
+			t.Errorf("bhistStatus of %q = %+v, %v, %v, want %+v, %v", test.output, got, known, err, test.want, test.known)
+		}
+	}
+
+	fakeCommand(t, dir, "bhist", "LSF is down", 255)
+	if _, _, err := bhistStatus("1"); err == nil {
+		t.Errorf("bhistStatus succeeded when bhist failed")
+	}
+}
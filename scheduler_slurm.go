@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// slurm_scheduler submits jobs with sbatch and checks on them with sacct, or
+// with squeue while they have yet to reach the accounting database or if
+// sacct is unavailable.
+type slurm_scheduler struct {
+	partition string
+}
+
+func newSlurmScheduler(partition string) *slurm_scheduler {
+	return &slurm_scheduler{partition: partition}
+}
+
+func (s *slurm_scheduler) Detachable() bool {
+	return true
+}
+
+func (s *slurm_scheduler) Commands() []string {
+	return []string{"sbatch", "sacct", "squeue", "scancel"}
+}
+
+// SubmitCommand returns the sbatch command line that submits the job
+func (s *slurm_scheduler) SubmitCommand(job job_spec) []string {
+	args := []string{"sbatch", "--parsable", "-o", job.Stdout, "-e", job.Stderr}
+	if job.Name != "" {
+		args = append(args, "-J", job.Name)
+	}
+	if job.Memory > 0 {
+		args = append(args, "--mem="+strconv.Itoa(job.Memory))
+	}
+	if job.Threads > 1 {
+		args = append(args, "-c", strconv.Itoa(job.Threads))
+	}
+	if s.partition != "" {
+		args = append(args, "-p", s.partition)
+	}
+	return append(args, "--wrap", shellQuote(job.Command))
+}
+
+func (s *slurm_scheduler) Submit(job job_spec) (string, error) {
+	args := s.SubmitCommand(job)
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("sbatch failed: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	// --parsable prints "jobid" or "jobid;cluster"
+	job_id := strings.Split(strings.TrimSpace(string(output)), ";")[0]
+	if _, err := strconv.Atoi(job_id); err != nil {
+		return "", fmt.Errorf("unable to find job id in sbatch output: %s", strings.TrimSpace(string(output)))
+	}
+	return job_id, nil
+}
+
+// accounting returns the state and exit code sacct reports for the job, both
+// of which are empty if the job has not yet reached the accounting database.
+func (s *slurm_scheduler) accounting(job_id string) (string, string, error) {
+	output, err := exec.Command(
+		"sacct", "-j", job_id, "-X", "-n", "-P", "-o", "State,ExitCode").CombinedOutput()
+	if err != nil {
+		return "", "", fmt.Errorf("sacct failed: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	line := strings.TrimSpace(strings.Split(string(output), "\n")[0])
+	if line == "" {
+		return "", "", nil
+	}
+	fields := strings.Split(line, "|")
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected sacct output: %s", line)
+	}
+	// states such as "CANCELLED by 1234" carry extra information after the state
+	state := strings.Fields(fields[0])[0]
+	return state, fields[1], nil
+}
+
+// queueState returns the state squeue reports for the job, which is empty
+// if the job isn't in the queue
+func (s *slurm_scheduler) queueState(job_id string) (string, error) {
+	output, err := exec.Command("squeue", "-h", "-j", job_id, "-o", "%T").CombinedOutput()
+	if err != nil {
+		// squeue fails for job ids that are no longer in the queue
+		if strings.Contains(string(output), "Invalid job id") {
+			return "", nil
+		}
+		return "", fmt.Errorf("squeue failed: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// Poll reads the job's state from the accounting database, and from the queue
+// if it hasn't reached the database yet or sacct fails, as it does when
+// accounting is turned off or slurmdbd is down. A job in neither is lost, so
+// that its outputs can be adopted or it can be retried.
+func (s *slurm_scheduler) Poll(job_id string) (job_state, error) {
+	state, _, err := s.accounting(job_id)
+	if err != nil || state == "" {
+		state, err = s.queueState(job_id)
+		if err != nil {
+			return job_pending, err
+		}
+		if state == "" {
+			return job_lost, nil
+		}
+	}
+	switch state {
+	case "PENDING", "REQUEUED", "RESIZING", "SUSPENDED":
+		return job_pending, nil
+	case "RUNNING", "COMPLETING", "CONFIGURING", "STAGE_OUT", "SIGNALING":
+		return job_running, nil
+	}
+	return job_finished, nil
+}
+
+func (s *slurm_scheduler) Cancel(job_id string) error {
+	output, err := exec.Command("scancel", job_id).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("scancel failed: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (s *slurm_scheduler) ExitStatus(job_id string) (int, error) {
+	state, exit_code, err := s.accounting(job_id)
+	if err != nil {
+		return -1, err
+	}
+	if state == "COMPLETED" {
+		return 0, nil
+	}
+
+	// ExitCode is given as "exitcode:signal"
+	code, err := strconv.Atoi(strings.Split(exit_code, ":")[0])
+	if err != nil {
+		return -1, fmt.Errorf("unable to parse exit code '%s' of slurm job %s", exit_code, job_id)
+	}
+	if code == 0 {
+		// cancelled, timed out or killed for exceeding its memory, none of
+		// which leave a non-zero exit code
+		return -1, nil
+	}
+	return code, nil
+}
+
+func (s *slurm_scheduler) OutOfMemory(job_id string) (bool, error) {
+	state, _, err := s.accounting(job_id)
+	if err != nil {
+		return false, err
+	}
+	return state == "OUT_OF_MEMORY", nil
+}
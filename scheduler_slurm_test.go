@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestSlurmAccounting(t *testing.T) {
+	dir, cleanup := fakeCommandDir(t)
+	defer cleanup()
+
+	s := &slurm_scheduler{}
+	tests := []struct {
+		output      string
+		exit_status int
+		state       string
+		exit_code   string
+		fails       bool
+	}{
+		{"", 0, "", "", false},
+		{"PENDING|0:0", 0, "PENDING", "0:0", false},
+		{"COMPLETED|0:0\n", 0, "COMPLETED", "0:0", false},
+		{"FAILED|2:0", 0, "FAILED", "2:0", false},
+		{"CANCELLED by 1234|0:15", 0, "CANCELLED", "0:15", false},
+		{"OUT_OF_MEMORY|0:125\nOUT_OF_MEMORY|0:125", 0, "OUT_OF_MEMORY", "0:125", false},
+		{"RUNNING", 0, "", "", true},
+		{"sacct: error: slurmdbd is down", 1, "", "", true},
+	}
+	for _, test := range tests {
+		fakeCommand(t, dir, "sacct", test.output, test.exit_status)
+		state, exit_code, err := s.accounting("1")
+		if state != test.state || exit_code != test.exit_code || (err != nil) != test.fails {
+			t.Errorf("accounting of %q = %s, %s, %v, want %s, %s", test.output, state, exit_code, err, test.state, test.exit_code)
+		}
+	}
+}
+
+func TestSlurmPoll(t *testing.T) {
+	dir, cleanup := fakeCommandDir(t)
+	defer cleanup()
+
+	s := &slurm_scheduler{}
+	tests := []struct {
+		sacct        string
+		sacct_status int
+		squeue       string
+		want         job_state
+	}{
+		{"RUNNING|0:0", 0, "", job_running},
+		{"COMPLETED|0:0", 0, "", job_finished},
+		{"", 0, "PENDING", job_pending},
+		{"", 0, "", job_lost},
+		// accounting is turned off or slurmdbd is down
+		{"sacct: error: slurmdbd is down", 1, "RUNNING", job_running},
+		{"sacct: error: slurmdbd is down", 1, "COMPLETING", job_running},
+		{"sacct: error: slurmdbd is down", 1, "", job_lost},
+	}
+	for _, test := range tests {
+		fakeCommand(t, dir, "sacct", test.sacct, test.sacct_status)
+		fakeCommand(t, dir, "squeue", test.squeue, 0)
+		state, err := s.Poll("1")
+		if err != nil || state != test.want {
+			t.Errorf("Poll with sacct %q and squeue %q = %v, %v, want %v", test.sacct, test.squeue, state, err, test.want)
+		}
+	}
+}
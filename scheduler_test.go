@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// fakeCommandDir creates a directory for fake commands and puts it first on
+// the PATH, returning a function that removes it and restores the PATH
+func fakeCommandDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "fake_commands")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return dir, func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+// fakeCommand writes a script named name to dir, which prints output and
+// exits with exit_status
+func fakeCommand(t *testing.T, dir string, name string, output string, exit_status int) {
+	script := "#!/bin/sh\ncat <<'EOF'\n" + output + "\nEOF\nexit " + strconv.Itoa(exit_status) + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"samtools", "index", "run_1/D_realignments/a.bam"}, "samtools index run_1/D_realignments/a.bam"},
+		{[]string{"iget", "/seq/1234/1234_1#1.cram"}, "iget '/seq/1234/1234_1#1.cram'"},
+		{[]string{"echo", "GnT scRNA"}, "echo 'GnT scRNA'"},
+		{[]string{"echo", "it's"}, `echo 'it'\''s'`},
+		{[]string{"echo", ""}, "echo ''"},
+		{[]string{"echo", "$HOME", "a;b", "*"}, "echo '$HOME' 'a;b' '*'"},
+		{[]string{"--outSAMattrRGline", "ID:1", "-@3", "a=b,c%d+e"}, "--outSAMattrRGline ID:1 -@3 a=b,c%d+e"},
+	}
+	for _, test := range tests {
+		if got := shellQuote(test.args); got != test.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", test.args, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/seanlaidlaw/iRODS-Downloader/irods"
+)
+
+// selection describes crams chosen by their iRODS metadata rather than by run
+// and lane. Every given study and sample is queried separately, and each
+// query is narrowed by all of the where conditions.
+type selection struct {
+	studies []string
+	samples []string
+	where   []irods.Condition
+}
+
+func (sel *selection) empty() bool {
+	return len(sel.studies) == 0 && len(sel.samples) == 0 && len(sel.where) == 0
+}
+
+// queries returns the conditions of each iRODS query the selection is made of
+func (sel *selection) queries(sample_attribute string) [][]irods.Condition {
+	queries := [][]irods.Condition{
+		append([]irods.Condition{{Attribute: "type", Operator: "=", Value: "cram"}}, sel.where...),
+	}
+	queries = expandQueries(queries, "study_id", sel.studies)
+	queries = expandQueries(queries, sample_attribute, sel.samples)
+	return queries
+}
+
+// expandQueries makes a copy of every query for each of the values of the
+// attribute, or leaves the queries as they are if no values are given
+func expandQueries(queries [][]irods.Condition, attribute string, values []string) [][]irods.Condition {
+	if len(values) == 0 {
+		return queries
+	}
+	var expanded [][]irods.Condition
+	for _, query := range queries {
+		for _, value := range values {
+			conditions := append([]irods.Condition{}, query...)
+			conditions = append(conditions, irods.Condition{Attribute: attribute, Operator: "=", Value: value})
+			expanded = append(expanded, conditions)
+		}
+	}
+	return expanded
+}
+
+// parseWhere turns each "attribute=value" given with --where into a condition
+func parseWhere(values []string) ([]irods.Condition, error) {
+	var conditions []irods.Condition
+	for _, value := range values {
+		split_value := strings.SplitN(value, "=", 2)
+		if len(split_value) != 2 || strings.TrimSpace(split_value[0]) == "" {
+			return nil, fmt.Errorf("invalid --where '%s', expected attribute=value", value)
+		}
+		conditions = append(conditions, irods.Condition{
+			Attribute: strings.TrimSpace(split_value[0]),
+			Operator:  "=",
+			Value:     strings.TrimSpace(split_value[1]),
+		})
+	}
+	return conditions, nil
+}
+
+// readSampleFile reads a file with one sample name per line. Blank lines and
+// lines starting with '#' are ignored.
+func readSampleFile(sample_file_path string) ([]string, error) {
+	sample_file, err := os.Open(sample_file_path)
+	if err != nil {
+		return nil, err
+	}
+	defer sample_file.Close()
+
+	var samples []string
+	scanner := bufio.NewScanner(sample_file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		samples = append(samples, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("no samples found in %s", sample_file_path)
+	}
+	return samples, nil
+}
+
+// runLaneOfFilename gets the run and lane from a cram's filename, which is
+// named <run>_<lane>#<tag>.cram or <run>_<lane>_phix.cram
+func runLaneOfFilename(filename string) (string, string, bool) {
+	split_filename := strings.Split(strings.TrimSuffix(filename, ".cram"), "_")
+	if len(split_filename) < 2 {
+		return "", "", false
+	}
+	lane := strings.TrimSpace(strings.Split(split_filename[1], "#")[0])
+	return split_filename[0], lane, lane != ""
+}
+
+// selectRunLanes queries iRODS for the crams matching the selection and
+// groups them into run/lanes by their filenames, so that they are processed
+// in the same directories as when given by run and lane.
+func (p *pipeline) selectRunLanes(sel *selection) ([]*run_lane, error) {
+	selected := make(map[string]*run_lane)
+	seen := make(map[string]bool)
+	for _, conditions := range sel.queries(p.cfg.Attribute_with_sample_name) {
+		var description []string
+		for _, condition := range conditions {
+			description = append(description, condition.Attribute+" "+condition.Operator+" "+condition.Value)
+		}
+		log.Printf("Polling iRODS for crams where %s\n", strings.Join(description, " and "))
+
+		objects, err := p.irods.Query(conditions)
+		if err != nil {
+			return nil, fmt.Errorf("imeta query failed: %s", err.Error())
+		}
+		if len(objects) == 0 {
+			log.Printf("No iRODS data retrieved where %s\n", strings.Join(description, " and "))
+		}
+
+		for _, object := range objects {
+			if seen[object.Path()] {
+				continue
+			}
+			seen[object.Path()] = true
+
+			run, lane, ok := runLaneOfFilename(object.Name)
+			if !ok {
+				return nil, fmt.Errorf("unable to find run and lane of '%s'", object.Path())
+			}
+			rl, ok := selected[run+"_"+lane]
+			if !ok {
+				rl = &run_lane{Run: run, Lane: lane}
+				selected[rl.dir()] = rl
+			}
+			rl.selected = append(rl.selected, object)
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("No iRODS data retrieved with given selection")
+	}
+
+	var run_lanes []*run_lane
+	for _, rl := range selected {
+		run_lanes = append(run_lanes, rl)
+	}
+	sort.Slice(run_lanes, func(i, j int) bool {
+		return run_lanes[i].dir() < run_lanes[j].dir()
+	})
+	return run_lanes, nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// the stages each cram moves through, in the order they are run
+var cram_stages = []string{
+	stage_download, stage_checksum, stage_imeta, stage_fastq, stage_align, stage_quickcheck, stage_index,
+	stage_qc, stage_upload,
+}
+
+const (
+	status_done    = "done"
+	status_failed  = "failed"
+	status_running = "running"
+	status_pending = "pending"
+	status_skipped = "skipped"
+	status_stale   = "stale"
+	status_none    = "-"
+)
+
+type sample_status struct {
+	Run_lane      string
+	Filename      string
+	Sample_name   string
+	Library_type  string
+	Stage         string
+	Stages        map[string]string
+	Merge_missing []string
+}
+
+type library_totals struct {
+	Done        int
+	Failed      int
+	In_progress int
+	Skipped     int
+}
+
+type project_status struct {
+	Samples       []sample_status
+	Totals        map[string]*library_totals
+	Counts_matrix string
+}
+
+// stageStatuses works out from the cram's current stage whether each of its
+// stages has succeeded, failed or is still to run. primary is the cram a
+// merged cram's sample is aligned by, or nil for crams that weren't merged.
+func stageStatuses(cram *cram_file, primary *cram_file) map[string]string {
+	statuses := make(map[string]string)
+
+	current := cram.Stage
+	if cram.Stage == stage_failed {
+		current = cram.Failed_stage
+	}
+
+	reached := false
+	for _, stage := range cram_stages {
+		switch {
+		case cram.Stage == stage_skipped:
+			statuses[stage] = status_skipped
+		case cram.Stage == stage_done || cram.Stage == stage_merged:
+			statuses[stage] = status_done
+		case stage == current:
+			reached = true
+			if cram.Stage == stage_failed {
+				statuses[stage] = status_failed
+			} else if cram.Job_id != "" {
+				statuses[stage] = status_running
+			} else {
+				statuses[stage] = status_pending
+			}
+		case reached && cram.Stage == stage_failed:
+			statuses[stage] = status_none
+		case reached:
+			statuses[stage] = status_pending
+		default:
+			statuses[stage] = status_done
+		}
+	}
+
+	// finished crams that weren't aligned, either as their library type has no
+	// aligner or as they were merged into another cram's sample
+	if cram.Stage == stage_done && cram.Realigned_bam_path == "" {
+		statuses[stage_align] = status_none
+		statuses[stage_quickcheck] = status_none
+		statuses[stage_index] = status_none
+		statuses[stage_qc] = status_none
+	}
+	if len(cram.Qc_flags) > 0 && statuses[stage_qc] == status_done {
+		statuses[stage_qc] = "flagged"
+	}
+	// upload_collection is optional, so finished crams may not be uploaded
+	if (cram.Stage == stage_done || cram.Stage == stage_merged) && !cram.Uploaded {
+		statuses[stage_upload] = status_none
+	}
+	if cram.Fastqs_streamed && statuses[stage_fastq] == status_done {
+		statuses[stage_fastq] = "streamed"
+	}
+	if cram.Stage == stage_merged && primary != nil && primary.Stage != stage_done {
+		// until the merged bam is finished, the crams merged into it are as far
+		// along as it is
+		primary_statuses := stageStatuses(primary, nil)
+		for _, stage := range []string{stage_align, stage_quickcheck, stage_index, stage_qc, stage_upload} {
+			statuses[stage] = primary_statuses[stage]
+		}
+	} else if cram.Stage == stage_merged {
+		statuses[stage_align] = "merged"
+		statuses[stage_quickcheck] = status_none
+		statuses[stage_index] = status_none
+		statuses[stage_qc] = status_none
+	}
+	return statuses
+}
+
+// run_lane_checkpoint is the crams saved in the checkpoint of a run/lane
+type run_lane_checkpoint struct {
+	Run_lane string
+	Crams    []cram_file
+}
+
+// readProjectCheckpoints reads the checkpoint of every run/lane in the
+// project, in order of their run/lane
+func readProjectCheckpoints(project_root string) ([]run_lane_checkpoint, error) {
+	checkpoints, err := filepath.Glob(filepath.Join(project_root, "*", "checkpoint.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(checkpoints)
+
+	var run_lanes []run_lane_checkpoint
+	for _, checkpoint := range checkpoints {
+		cram_list, err := readCheckpoint(checkpoint)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %s", checkpoint, err.Error())
+		}
+		run_lanes = append(run_lanes, run_lane_checkpoint{filepath.Base(filepath.Dir(checkpoint)), cram_list})
+	}
+	return run_lanes, nil
+}
+
+// mergePrimaries returns the crams of the project by filename, so that the
+// primary cram of a merged cram can be looked up from its Merged_into
+func mergePrimaries(run_lanes []run_lane_checkpoint) map[string]*cram_file {
+	primaries := make(map[string]*cram_file)
+	for _, run_lane := range run_lanes {
+		for i := range run_lane.Crams {
+			primaries[run_lane.Crams[i].Filename] = &run_lane.Crams[i]
+		}
+	}
+	return primaries
+}
+
+// countsMatrixStatus reports whether the counts matrix was built from the RNA
+// bams of the given crams, is stale as it was built from other bams, or is
+// still to be built. Projects without RNA bams have no counts matrix.
+func (p *pipeline) countsMatrixStatus(project_root string, crams []*cram_file) string {
+	checkpoint_file := filepath.Join(project_root, "checkpoint_counts.json")
+	rna_bams := p.rnaBams(crams)
+	switch {
+	case len(rna_bams) > 0 && p.countsAreCurrent(checkpoint_file, rna_bams):
+		return status_done
+	case fileExists(checkpoint_file):
+		return status_stale
+	case len(rna_bams) > 0:
+		return status_pending
+	}
+	return status_none
+}
+
+// readProjectStatus reads the checkpoint of every run/lane in the project. The
+// config is needed to tell which bams the counts matrix is built from.
+func readProjectStatus(project_root string, cfg pipeline_config) (*project_status, error) {
+	run_lanes, err := readProjectCheckpoints(project_root)
+	if err != nil {
+		return nil, err
+	}
+	primaries := mergePrimaries(run_lanes)
+
+	status := &project_status{Totals: make(map[string]*library_totals)}
+	var crams []*cram_file
+	for _, run_lane := range run_lanes {
+		for i := range run_lane.Crams {
+			cram := &run_lane.Crams[i]
+			crams = append(crams, cram)
+			primary := primaries[cram.Merged_into]
+			status.Samples = append(status.Samples, sample_status{
+				Run_lane:      run_lane.Run_lane,
+				Filename:      cram.Filename,
+				Sample_name:   cram.Sample_name,
+				Library_type:  cram.Library_type,
+				Stage:         cram.Stage,
+				Stages:        stageStatuses(cram, primary),
+				Merge_missing: cram.Merge_missing,
+			})
+
+			addToTotals(status.Totals, cram, primary)
+		}
+	}
+	p := &pipeline{cfg: cfg}
+	status.Counts_matrix = p.countsMatrixStatus(project_root, crams)
+	return status, nil
+}
+
+// addToTotals counts the cram in the totals of its library type. Crams merged
+// into another's sample count as done only once its primary is, and as failed
+// if its primary failed.
+func addToTotals(totals map[string]*library_totals, cram *cram_file, primary *cram_file) {
+	library_type := cram.Library_type
+	if library_type == "" {
+		library_type = "unknown"
+	}
+	library, ok := totals[library_type]
+	if !ok {
+		library = &library_totals{}
+		totals[library_type] = library
+	}
+	stage := cram.Stage
+	if stage == stage_merged && primary != nil {
+		stage = primary.Stage
+	}
+	switch stage {
+	case stage_done, stage_merged:
+		library.Done++
+	case stage_failed:
+		library.Failed++
+	case stage_skipped:
+		library.Skipped++
+	default:
+		library.In_progress++
+	}
+}
+
+func printProjectStatus(status *project_status) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprint(w, "RUN_LANE\tFILENAME\tSAMPLE\tLIBRARY_TYPE")
+	for _, stage := range cram_stages {
+		fmt.Fprintf(w, "\t%s", stage)
+	}
+	fmt.Fprintln(w)
+	for _, sample := range status.Samples {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s", sample.Run_lane, sample.Filename, sample.Sample_name, sample.Library_type)
+		for _, stage := range cram_stages {
+			fmt.Fprintf(w, "\t%s", sample.Stages[stage])
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+
+	for _, sample := range status.Samples {
+		if len(sample.Merge_missing) > 0 {
+			fmt.Printf("Sample %s was merged without %s, which failed before alignment\n",
+				sample.Sample_name, strings.Join(sample.Merge_missing, ", "))
+		}
+	}
+
+	var library_types []string
+	for library_type := range status.Totals {
+		library_types = append(library_types, library_type)
+	}
+	sort.Strings(library_types)
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LIBRARY_TYPE\tDONE\tFAILED\tIN_PROGRESS\tSKIPPED")
+	for _, library_type := range library_types {
+		totals := status.Totals[library_type]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n",
+			library_type, totals.Done, totals.Failed, totals.In_progress, totals.Skipped)
+	}
+	w.Flush()
+
+	fmt.Println()
+	fmt.Printf("Counts matrix: %s\n", status.Counts_matrix)
+}
+
+// statusCommand implements "irods_downloader status", summarising the
+// progress of a project from its checkpoints.
+func statusCommand(args []string) {
+	var project_root string
+	var as_json bool
+
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	flags.StringVar(&project_root, "p", ".", "Specify the project root directory")
+	flags.BoolVar(&as_json, "json", false, "Print the status as JSON")
+	flags.Parse(args)
+
+	cfg, _, err := loadConfig(project_root)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	status, err := readProjectStatus(project_root, cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(status.Samples) == 0 {
+		log.Fatalf("No checkpoints found in %s\n", project_root)
+	}
+
+	if as_json {
+		statusJson, _ := json.MarshalIndent(status, "", "  ")
+		fmt.Println(string(statusJson))
+		return
+	}
+	printProjectStatus(status)
+}
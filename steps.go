@@ -0,0 +1,1044 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/seanlaidlaw/iRODS-Downloader/irods"
+)
+
+// stages a cram moves through, in order. A cram ends in one of stage_done,
+// stage_failed, stage_skipped (phiX crams that aren't downloaded) or
+// stage_merged (crams aligned as part of another cram's sample).
+const (
+	stage_download   = "download"
+	stage_checksum   = "checksum"
+	stage_imeta      = "imeta"
+	stage_fastq      = "fastq"
+	stage_align      = "align"
+	stage_quickcheck = "quickcheck"
+	stage_index      = "index"
+	stage_qc         = "qc"
+	stage_upload     = "upload"
+	stage_done       = "done"
+	stage_failed     = "failed"
+	stage_skipped    = "skipped"
+	stage_merged     = "merged"
+)
+
+func stageIsFinal(stage string) bool {
+	return stringInSlice(stage, []string{stage_done, stage_failed, stage_skipped, stage_merged})
+}
+
+// pipeline holds everything shared between the stages of a project: the
+// parsed config, the scheduler jobs are run through, the iRODS client and the
+// run/lanes being processed. Jobs that need irods_downloader itself run
+// executable. In a dry run nothing is written to disk and no jobs are
+// submitted. Signals asking irods_downloader to stop are passed on
+// interrupts.
+type pipeline struct {
+	cfg           pipeline_config
+	sched         scheduler
+	irods         irods.Client
+	executable    string
+	run_lanes     []*run_lane
+	dry_run       bool
+	tool_versions map[string]string
+	interrupts    chan os.Signal
+}
+
+// activeRunLanes returns the run/lanes that have not failed to be queried
+func (p *pipeline) activeRunLanes() []*run_lane {
+	var active []*run_lane
+	for _, rl := range p.run_lanes {
+		if !rl.failed {
+			active = append(active, rl)
+		}
+	}
+	return active
+}
+
+// writeCheckpoints saves the state of every active run/lane
+func (p *pipeline) writeCheckpoints() {
+	for _, rl := range p.activeRunLanes() {
+		rl.writeCheckpoint()
+	}
+}
+
+// loadOrQuery loads the checkpoint of every run/lane that has one, and polls
+// iRODS for the crams of those that don't. Jobs recorded in a checkpoint were
+// left running by a previous invocation, and are reattached to if the
+// scheduler keeps jobs running once irods_downloader exits. Otherwise the
+// stages they were running are started again. Run/lanes found by a metadata
+// selection already have their crams, and any not yet in their checkpoint are
+// added to it. A run/lane whose checkpoint can't be read is failed, rather
+// than queried again, so that its progress isn't overwritten.
+func (p *pipeline) loadOrQuery() {
+	for _, rl := range p.run_lanes {
+		if fileExists(rl.checkpointPath()) {
+			err := rl.loadCheckpoint()
+			if err != nil {
+				rl.fail(fmt.Errorf("unable to read %s: %s", rl.checkpointPath(), err.Error()))
+				continue
+			}
+			for i := range rl.crams {
+				p.reattachJob(&rl.crams[i])
+				p.queueQc(&rl.crams[i])
+				p.queueUpload(&rl.crams[i])
+			}
+			log.Println(fmt.Sprintf("Checkpoint exists for %s, loading progress", rl))
+			if len(rl.selected) > 0 {
+				err = p.addCrams(rl, rl.selected)
+				if err != nil {
+					rl.fail(err)
+				} else if !p.dry_run {
+					rl.writeCheckpoint()
+				}
+			}
+			continue
+		}
+
+		var err error
+		if !p.dry_run {
+			err = os.MkdirAll(rl.dir(), 0755)
+		}
+		if err == nil && len(rl.selected) > 0 {
+			err = p.addCrams(rl, rl.selected)
+		} else if err == nil {
+			err = p.queryRunLane(rl)
+		}
+		if err != nil {
+			rl.fail(err)
+			continue
+		}
+		if !p.dry_run {
+			rl.writeCheckpoint()
+		}
+	}
+}
+
+// Assess what CRAM files are being requested
+func (p *pipeline) queryRunLane(rl *run_lane) error {
+	log.Println(fmt.Sprintf("Polling iRODS for crams associated with run: %s, and lane: %s", rl.Run, rl.Lane))
+	objects, err := p.irods.Query([]irods.Condition{
+		{Attribute: "id_run", Operator: "=", Value: rl.Run},
+		{Attribute: "lane", Operator: "=", Value: rl.Lane},
+		{Attribute: "type", Operator: "=", Value: "cram"},
+	})
+	if err != nil {
+		return fmt.Errorf("imeta query failed: %s", err.Error())
+	}
+
+	if len(objects) == 0 {
+		return fmt.Errorf("No iRODS data retrieved with given lane and run")
+	}
+	return p.addCrams(rl, objects)
+}
+
+// addCrams parses each cram file returned by iRODS into its own object, with
+// its run, lane and iRODS path as object metadata, and adds those the
+// run/lane doesn't already have to its cram list.
+func (p *pipeline) addCrams(rl *run_lane, objects []irods.Data_object) error {
+	log.Println("Parsing iRODS output to generate list of crams")
+	known := make(map[string]bool)
+	for _, cram := range rl.crams {
+		known[cram.Filename] = true
+	}
+
+	first_added := len(rl.crams)
+	zone_prefix := "/" + irods_zone + "/"
+	for _, object := range objects {
+		if !strings.HasPrefix(object.Collection, zone_prefix) {
+			return fmt.Errorf("Revieved unexpected collection '%s' for file '%s'", object.Collection, object.Name)
+		}
+		if !strings.HasSuffix(object.Name, ".cram") {
+			return fmt.Errorf("Revieved unexpected filename '%s' when expecting cram", object.Name)
+		}
+
+		filename := object.Name
+		if known[filename] {
+			continue
+		}
+		known[filename] = true
+
+		split_filename := strings.Split(filename, "_")
+		phix_status := false
+		if stringInSlice("phix.cram", split_filename) {
+			phix_status = true
+		}
+		if strings.HasSuffix(filename, "#0.cram") {
+			phix_status = true
+		}
+		_, run_lane, _ := runLaneOfFilename(filename)
+
+		rl.crams = append(rl.crams, cram_file{
+			Filename:     filename,
+			Runid:        strings.TrimPrefix(object.Collection, zone_prefix),
+			Runlane:      run_lane,
+			Run_lane_dir: rl.dir(),
+			Irods_path:   object.Path(),
+			Cram_is_phix: phix_status,
+			Stage:        stage_skipped,
+		})
+	}
+
+	if len(rl.crams) < 1 {
+		return fmt.Errorf("There are less than 1 items in run's cram list")
+	}
+
+	// for each new cram in iRODS check it exists and write result to object metadata
+	log.Println("Verifying each iRODS cram file exists")
+	for i := first_added; i < len(rl.crams); i++ {
+		cram := &rl.crams[i]
+		if cram.Cram_is_phix == false {
+			exists, err := p.irods.Exists(cram.Irods_path)
+			if err == nil && !exists {
+				err = fmt.Errorf("data object does not exist")
+			}
+			if err != nil {
+				return fmt.Errorf("ils failed for %s: %s", cram.Irods_path, err.Error())
+			}
+			cram.File_exists_in_irods = true
+			cram.Stage = stage_download
+		}
+	}
+
+	cram_exists_count := 0
+	for _, cram := range rl.crams {
+		if cram.File_exists_in_irods {
+			cram_exists_count++
+		}
+	}
+	if cram_exists_count < 1 {
+		return fmt.Errorf("There are no crams in cram exists list")
+	}
+	return nil
+}
+
+// advanceCrams moves every cram through its stages until all of them have
+// finished or failed, saving the checkpoints whenever a cram changes stage or
+// has a job submitted.
+func (p *pipeline) advanceCrams() {
+	for {
+		changed := false
+		unfinished := 0
+		for _, cram := range cramsOf(p.activeRunLanes()) {
+			for !stageIsFinal(cram.Stage) && p.advance(cram) {
+				changed = true
+			}
+			if !stageIsFinal(cram.Stage) {
+				unfinished++
+			}
+		}
+
+		if changed {
+			p.syncMergedCrams()
+			p.applyRetention()
+			p.writeCheckpoints()
+		}
+		if unfinished == 0 {
+			return
+		}
+		// sleep for 5 seconds after going through every cram before retrying
+		if sig := p.sleep(5 * time.Second); sig != nil {
+			p.interrupt(sig)
+		}
+	}
+}
+
+// advance does whatever the cram's current stage requires next, returning
+// whether anything changed. It returns false while waiting on a job. Inputs
+// of the stage that were removed by cleanup are made again first.
+func (p *pipeline) advance(cram *cram_file) bool {
+	if cram.Job_id == "" && p.restoreRemovedInputs(cram) {
+		return true
+	}
+
+	switch cram.Stage {
+	case stage_download:
+		return p.runJob(cram, p.downloadJob, "Cram_download_success", stage_checksum)
+
+	case stage_checksum:
+		p.verifyChecksum(cram)
+		return true
+
+	case stage_imeta:
+		p.fetchImeta(cram)
+		return true
+
+	case stage_fastq:
+		if p.streamsFastqs(cram) {
+			// the alignment job extracts the reads itself
+			cram.Stage = stage_align
+			return true
+		}
+		advanced := p.runJob(cram, p.fastqJob, "Fastq_extracted_success", stage_align)
+		if advanced && cram.Stage == stage_align {
+			p.symlinkFastq(cram)
+		}
+		return advanced
+
+	case stage_align:
+		if !p.streamsFastqs(cram) && !cram.Fastq_extracted_success {
+			// reached by streaming, but streaming has since been turned off
+			cram.Stage = stage_fastq
+			return true
+		}
+		if p.cfg.Merge_samples_across_lanes {
+			return p.alignMergedSample(cram)
+		}
+		if p.alignerProfile(cram.Library_type) == nil {
+			// library types without an aligner are finished once extracted
+			cram.Stage = stage_done
+			return true
+		}
+		return p.runJob(cram, p.alignJob, "Realigned_succesful", stage_quickcheck)
+
+	case stage_quickcheck:
+		return p.runJob(cram, p.quickcheckJob, "Realigned_quickcheck_success", stage_index)
+
+	case stage_index:
+		return p.runJob(cram, p.indexJob, "Realigned_index_success", stage_qc)
+
+	case stage_qc:
+		next_stage := p.stageAfterQc(cram)
+		advanced := p.runJob(cram, p.qcJob, "Qc_metrics_collected", next_stage)
+		if advanced && cram.Stage == next_stage {
+			if err := p.readQcMetrics(cram); err != nil {
+				log.Println(err)
+				cram.Stage = stage_qc
+				p.failCram(cram, "unable to read QC metrics")
+			}
+		}
+		return advanced
+
+	case stage_upload:
+		return p.runJob(cram, p.uploadJob, "Uploaded", stage_done)
+	}
+	return false
+}
+
+// completeStage moves the cram on to next_stage if its current stage
+// succeeded, otherwise marks it as failed at its current stage.
+func (p *pipeline) completeStage(cram *cram_file, success bool, next_stage string) {
+	cram.Job_id = ""
+	if success {
+		cram.Stage = next_stage
+		return
+	}
+	p.failCram(cram, fmt.Sprintf("stage %s failed", cram.Stage))
+}
+
+func (p *pipeline) failCram(cram *cram_file, reason string) {
+	log.Printf("Stopping %s: %s\n", cram.Filename, reason)
+	cram.Failed_stage = cram.Stage
+	cram.Job_id = ""
+	cram.Stage = stage_failed
+}
+
+// runJob submits the job built by build_job for the cram's current stage if
+// it hasn't been already, or checks on it if it has. Once the job finishes
+// the cram moves on to next_stage if attribute_name was set by a successful
+// exit, or fails otherwise.
+func (p *pipeline) runJob(
+	cram *cram_file,
+	build_job func(cram *cram_file) job_spec,
+	attribute_name string,
+	next_stage string,
+) bool {
+	if cram.Job_id == "" {
+		// waiting to retry a failed attempt
+		if time.Now().Before(cram.Retry_after) {
+			return false
+		}
+
+		job := build_job(cram)
+		attempt := p.prepareAttempt(cram, &job)
+		err := os.MkdirAll(filepath.Dir(job.Stdout), 0755)
+		if err == nil {
+			err = writeJobScript(job)
+		}
+		var job_id string
+		if err == nil {
+			job_id, err = p.sched.Submit(job)
+		}
+		if err != nil {
+			log.Printf("Got submission status: %s\n", err.Error())
+			attempt.Finished = true
+			attempt.Exit_status = -1
+			if !p.retryJob(cram) {
+				p.failCram(cram, "unable to submit job")
+			}
+			return true
+		}
+		cram.Job_id = job_id
+		attempt.Job_id = job_id
+		// saved straight away, so that the job is reattached to rather than
+		// submitted again if irods_downloader stops before the end of the pass
+		p.writeCheckpointOf(cram)
+		return true
+	}
+
+	state, exit_status := jobIsCompleted(p.sched, cram, attribute_name)
+	if state == job_lost && p.adoptOutputs(cram, attribute_name) {
+		exit_status = 0
+	}
+	if state != job_finished && state != job_lost && !p.jobTimedOut(cram) {
+		return false
+	}
+
+	success := reflect.ValueOf(cram).Elem().FieldByName(attribute_name).Bool()
+	p.recordAttempt(cram, exit_status)
+	if !success && p.retryJob(cram) {
+		return true
+	}
+	p.completeStage(cram, success, next_stage)
+	return true
+}
+
+// Download CRAM file, then checksum the download so that the checksum stage
+// doesn't have to read it again
+func (p *pipeline) downloadJob(cram *cram_file) job_spec {
+	cram_dl_dir := cram.Run_lane_dir + "/A_iRODS_CRAM_Downloads"
+
+	cram.Cram_dl_path = cram_dl_dir + "/" + cram.Filename
+	return scriptJob(job_spec{
+		Name:   "A_iget_" + cram.Filename,
+		Stdout: cram_dl_dir + "/" + cram.Filename + ".o",
+		Stderr: cram_dl_dir + "/" + cram.Filename + ".e",
+		Memory: 2000,
+	}, cram_dl_dir+"/A_iget_"+cram.Filename+".sh", []string{
+		// checksums left by a previous attempt aren't of this download
+		shellQuote([]string{"rm", "-f", checksumsPath(cram)}),
+		shellQuote(p.irods.DownloadCommand(cram.Irods_path, cram.Cram_dl_path)),
+		shellQuote([]string{p.executable, "checksum", cram.Cram_dl_path, checksumsPath(cram)}),
+	})
+}
+
+// Download imeta for the cram file and parse it to obtain library_type and
+// sample name
+func (p *pipeline) fetchImeta(cram *cram_file) {
+	avus, err := p.irods.Metadata(cram.Irods_path)
+	if err != nil {
+		log.Println(err)
+		p.failCram(cram, "unable to download imeta")
+		return
+	}
+
+	// keep a copy of the metadata alongside the download
+	var imeta strings.Builder
+	for _, avu := range avus {
+		fmt.Fprintf(&imeta, "attribute: %s\nvalue: %s\nunits: %s\n----\n", avu.Attribute, avu.Value, avu.Units)
+	}
+	cram.Imeta_path = cram.Cram_dl_path + ".imeta"
+	err = ioutil.WriteFile(cram.Imeta_path, []byte(imeta.String()), 0644)
+	if err != nil {
+		log.Println(err)
+		p.failCram(cram, "unable to create imeta file")
+		return
+	}
+	cram.Imeta_downloaded = true
+	cram.Metadata = avus
+
+	p.parseImeta(cram)
+	if err := p.detectPairing(cram); err != nil {
+		log.Println(err)
+		p.failCram(cram, "unable to tell whether reads are paired")
+		return
+	}
+	p.checkSample(cram)
+}
+
+// checkSample fails the cram if its imeta didn't give its sample, or gave a
+// sample already used by another cram, and otherwise moves it on to have its
+// fastqs extracted.
+func (p *pipeline) checkSample(cram *cram_file) {
+	if !cram.Imeta_parsed || cram.Library_type == "" {
+		p.failCram(cram, "no library_type or sample name found in imeta")
+		return
+	}
+	for _, attribute := range p.cfg.Required_attributes {
+		if _, ok := cram.attribute(attribute); !ok {
+			p.failCram(cram, fmt.Sprintf("required attribute '%s' not found in imeta", attribute))
+			return
+		}
+	}
+
+	// sample names are checked across the whole project, as they share the
+	// counts matrix. When merging, crams sharing a sample name are merged into
+	// one bam so duplicates are expected
+	if !p.cfg.Merge_samples_across_lanes {
+		for _, other := range cramsOf(p.activeRunLanes()) {
+			if other != cram && other.Imeta_parsed && other.Stage != stage_failed &&
+				other.Library_type == cram.Library_type && other.Sample_name == cram.Sample_name {
+				log.Printf("Duplicate sample_names found for %s", cram.Sample_name)
+				log.Println("There are duplicate values in sample_names, double check your choice of 'attribute_with_sample_name'")
+				p.failCram(cram, "duplicate sample name")
+				return
+			}
+		}
+	}
+
+	cram.Stage = stage_fastq
+}
+
+// parseImeta reads the library_type and sample name of the cram from its
+// metadata, taking the first value of each attribute
+func (p *pipeline) parseImeta(cram *cram_file) {
+	if library_type, ok := cram.attribute(p.cfg.Library_type_attribute); ok {
+		cram.Library_type = library_type
+	}
+	if sample_name, ok := cram.attribute(p.cfg.Attribute_with_sample_name); ok && sample_name != "" {
+		cram.Sample_name = sample_name
+		cram.Imeta_parsed = true
+	}
+}
+
+// Convert the CRAM file to fastq. Paired reads are split into two fastqs,
+// while the reads of single-end crams, which samtools counts as neither read 1
+// nor read 2, are written to a single fastq. The index reads of library types
+// in index_read_libraries are extracted from their BC tags as well.
+func (p *pipeline) fastqJob(cram *cram_file) job_spec {
+	fastq_dir := cram.Run_lane_dir + "/B_Fastq_Extraction"
+
+	fq_filename := strings.ReplaceAll(cram.Filename, ".cram", "")
+	cram.Fastq_1_path = fastq_dir + "/" + fq_filename + ".1.fq.gz"
+	cram.Fastq_2_path = ""
+
+	cmd := []string{p.cfg.Samtools_exec, "fastq", "-c", "7", "-@", "4"}
+	if cram.Single_end {
+		cmd = append(cmd, "-0", cram.Fastq_1_path)
+	} else {
+		cram.Fastq_2_path = fastq_dir + "/" + fq_filename + ".2.fq.gz"
+		cmd = append(cmd,
+			"-1", cram.Fastq_1_path,
+			"-2", cram.Fastq_2_path,
+			"-0", "/dev/null",
+			"-s", "/dev/null")
+	}
+	cmd = append(cmd, p.indexReadArgs(cram)...)
+	cmd = append(cmd, "-n", cram.Cram_dl_path)
+
+	return job_spec{
+		Name:    "B_cram_to_fastq_" + cram.Filename,
+		Stdout:  fastq_dir + "/B_cram_to_fastq_" + cram.Filename + ".o",
+		Stderr:  fastq_dir + "/B_cram_to_fastq_" + cram.Filename + ".e",
+		Memory:  2000,
+		Threads: 4,
+		Command: cmd,
+	}
+}
+
+// Symlink the fastqs to different folders depending on 'Library_type'
+func (p *pipeline) symlinkFastq(cram *cram_file) {
+	p.setSymlinkPaths(cram)
+	_ = os.MkdirAll(filepath.Dir(cram.Symlinked_fq_1), 0755)
+	for _, link := range fastqLinks(cram) {
+		relativeSymlink(link[0], link[1])
+	}
+}
+
+// setSymlinkPaths works out where the cram's fastqs are symlinked to
+func (p *pipeline) setSymlinkPaths(cram *cram_file) {
+	lib_type_dir := strings.ReplaceAll(cram.Library_type, " ", "_")
+	lib_type_dir = cram.Run_lane_dir + "/C_Split_by_Library_Type/" + lib_type_dir
+	// the same sample can appear several times in a lane when merging
+	// so the lane's filename is kept to tell them apart
+	link_name := cram.Sample_name
+	if p.cfg.Merge_samples_across_lanes {
+		link_name = cram.Sample_name + "_" + strings.TrimSuffix(cram.Filename, ".cram")
+	}
+	cram.Symlinked_fq_1 = lib_type_dir + "/" + link_name + ".1.fq.gz"
+	cram.Symlinked_fq_2 = ""
+	cram.Symlinked_i1 = ""
+	cram.Symlinked_i2 = ""
+	if cram.Fastq_2_path != "" {
+		cram.Symlinked_fq_2 = lib_type_dir + "/" + link_name + ".2.fq.gz"
+	}
+	if cram.Index_1_path != "" {
+		cram.Symlinked_i1 = lib_type_dir + "/" + link_name + ".i1.fq.gz"
+		cram.Symlinked_i2 = lib_type_dir + "/" + link_name + ".i2.fq.gz"
+	}
+}
+
+// indexReadArgs sets where the index reads of library types in
+// index_read_libraries are extracted to, returning the samtools fastq
+// arguments that extract them
+func (p *pipeline) indexReadArgs(cram *cram_file) []string {
+	cram.Index_1_path = ""
+	cram.Index_2_path = ""
+	if !stringInSlice(cram.Library_type, p.cfg.Index_read_libraries) {
+		return nil
+	}
+	fq_prefix := cram.Run_lane_dir + "/B_Fastq_Extraction/" + strings.ReplaceAll(cram.Filename, ".cram", "")
+	cram.Index_1_path = fq_prefix + ".i1.fq.gz"
+	cram.Index_2_path = fq_prefix + ".i2.fq.gz"
+	return []string{"--i1", cram.Index_1_path, "--i2", cram.Index_2_path}
+}
+
+// fastqLinks returns the fastqs the cram extracted, each paired with where it
+// is symlinked to
+func fastqLinks(cram *cram_file) [][2]string {
+	var links [][2]string
+	for _, link := range [][2]string{
+		{cram.Fastq_1_path, cram.Symlinked_fq_1},
+		{cram.Fastq_2_path, cram.Symlinked_fq_2},
+		{cram.Index_1_path, cram.Symlinked_i1},
+		{cram.Index_2_path, cram.Symlinked_i2},
+	} {
+		if link[0] != "" && link[1] != "" {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// relativeSymlink creates a symlink at link_path pointing to target, using a
+// path relative to the link so the project directory can be moved.
+func relativeSymlink(target string, link_path string) {
+	relative_target, err := filepath.Rel(filepath.Dir(link_path), target)
+	if err != nil {
+		relative_target = target
+	}
+	os.Remove(link_path)
+	os.Symlink(relative_target, link_path)
+}
+
+// Align extracted fastqs with the aligner profile of the cram's 'Library_type'
+func (p *pipeline) alignJob(cram *cram_file) job_spec {
+	out_folder := cram.Run_lane_dir + "/D_realignments/" + strings.ReplaceAll(cram.Library_type, " ", "_") + "/"
+
+	bam_output := out_folder + cram.Sample_name + ".bam"
+	job_out := out_folder + "/D_realignement_RNA_" + cram.Sample_name + ".o"
+	job_err := out_folder + "/D_realignement_RNA_" + cram.Sample_name + ".e"
+
+	aligner := p.alignerProfile(cram.Library_type)
+	lines := p.alignLines(cram, aligner, out_folder+"/"+cram.Filename, bam_output)
+	cram.Realigned_bam_path = bam_output
+	cram.Realigned_script_path = strings.TrimSuffix(job_out, ".o") + ".sh"
+
+	return scriptJob(job_spec{
+		Name:    aligner.jobPrefix() + cram.Sample_name,
+		Stdout:  job_out,
+		Stderr:  job_err,
+		Memory:  aligner.Memory,
+		Threads: aligner.Threads,
+	}, cram.Realigned_script_path, lines)
+}
+
+// alignLines returns the script lines that align the cram into bam_output,
+// either from its extracted fastqs or streaming its reads from the CRAM
+func (p *pipeline) alignLines(cram *cram_file, aligner *aligner_profile, out_prefix string, bam_output string) []string {
+	cram.Aligner_out_prefix = out_prefix
+	if p.streamsFastqs(cram) {
+		return p.streamAlignLines(cram, aligner, out_prefix, bam_output)
+	}
+	cram.Fastqs_streamed = false
+	aligner_cmd := aligner.command(cram, cram.Symlinked_fq_1, cram.Symlinked_fq_2, out_prefix, p.readGroup(cram), false)
+	return []string{shellQuote(aligner_cmd) + " | " + shellQuote(p.sortCommand(bam_output))}
+}
+
+func (p *pipeline) sortCommand(bam_output string) []string {
+	return []string{p.cfg.Samtools_exec, "sort", "-@3", "-l7", "-o", bam_output}
+}
+
+// bamName is the name of the cram's bam without its extension, which names
+// the jobs run on it. Bams are named after their sample, and merged bams after
+// their primary cram as well, as a sample can have more than one.
+func bamName(cram *cram_file) string {
+	return strings.TrimSuffix(filepath.Base(cram.Realigned_bam_path), ".bam")
+}
+
+// quickcheckJob checks the cram's bam is intact, which it may not be if its
+// alignment job was killed while writing it
+func (p *pipeline) quickcheckJob(cram *cram_file) job_spec {
+	bam := cram.Realigned_bam_path
+	job_prefix := filepath.Dir(bam) + "/D_quickcheck_" + bamName(cram)
+	return job_spec{
+		Name:    "D_quickcheck_" + bamName(cram),
+		Stdout:  job_prefix + ".o",
+		Stderr:  job_prefix + ".e",
+		Memory:  1000,
+		Command: []string{p.cfg.Samtools_exec, "quickcheck", bam},
+	}
+}
+
+// indexJob indexes the cram's bam
+func (p *pipeline) indexJob(cram *cram_file) job_spec {
+	bam := cram.Realigned_bam_path
+	job_prefix := filepath.Dir(bam) + "/D_index_" + bamName(cram)
+	return job_spec{
+		Name:    "D_index_" + bamName(cram),
+		Stdout:  job_prefix + ".o",
+		Stderr:  job_prefix + ".e",
+		Memory:  1000,
+		Command: []string{p.cfg.Samtools_exec, "index", bam},
+	}
+}
+
+// sampleKey identifies crams that belong to the same sample, and so are
+// merged when merge_samples_across_lanes is set
+func sampleKey(cram *cram_file) string {
+	return cram.Library_type + "/" + cram.Sample_name
+}
+
+// mergeGroup returns the given cram followed by the other crams sharing its
+// sample, once every cram in the project that could belong to that sample has
+// finished extracting its fastqs. Crams of the sample that failed before they
+// could be aligned are returned separately, as the sample is merged without
+// them. Crams that failed before their imeta was parsed can't be told apart,
+// as their sample isn't known.
+func (p *pipeline) mergeGroup(cram *cram_file) ([]*cram_file, []*cram_file, bool) {
+	members := []*cram_file{cram}
+	var missing []*cram_file
+	for _, other := range cramsOf(p.activeRunLanes()) {
+		// the sample of crams that haven't had their imeta parsed isn't known yet
+		if other.Stage == stage_download || other.Stage == stage_checksum || other.Stage == stage_imeta {
+			return nil, nil, false
+		}
+		if other == cram || sampleKey(other) != sampleKey(cram) {
+			continue
+		}
+		if other.Stage == stage_fastq {
+			return nil, nil, false
+		}
+		if (other.Stage == stage_align && other.Merged_into == "") || other.Merged_into == cram.Filename {
+			members = append(members, other)
+		} else if other.Stage == stage_failed && stringInSlice(other.Failed_stage, pre_align_stages) {
+			missing = append(missing, other)
+		}
+	}
+	return members, missing, true
+}
+
+// pre_align_stages are the stages a cram can fail at before it is aligned,
+// and so before it is merged into its sample
+var pre_align_stages = []string{stage_download, stage_checksum, stage_imeta, stage_fastq}
+
+// alignMergedSample aligns each lane of the cram's sample with its own read
+// group and then merges the lanes into a single bam for the sample. The first
+// cram of each sample to be ready carries the job and the merged bam, the
+// others point to it through Merged_into and wait in stage_merged. The lanes
+// are aligned one after another within that single job, so that the merge
+// only starts once all of them have been aligned.
+func (p *pipeline) alignMergedSample(cram *cram_file) bool {
+	if p.alignerProfile(cram.Library_type) == nil {
+		// library types without an aligner are finished once extracted
+		cram.Stage = stage_done
+		return true
+	}
+
+	if cram.Job_id != "" {
+		return p.runJob(cram, nil, "Realigned_succesful", stage_quickcheck)
+	}
+
+	members, missing, ready := p.mergeGroup(cram)
+	if !ready {
+		return false
+	}
+
+	for _, member := range members[1:] {
+		member.Merged_into = cram.Filename
+		member.Stage = stage_merged
+	}
+	cram.Merge_missing = nil
+	for _, member := range missing {
+		log.Printf("Merging sample %s without %s: it failed at the %s stage\n", cram.Sample_name, member.Filename, member.Failed_stage)
+		cram.Merge_missing = append(cram.Merge_missing, member.Filename)
+	}
+
+	return p.runJob(cram, func(primary *cram_file) job_spec {
+		return p.mergedAlignJob(primary, members)
+	}, "Realigned_succesful", stage_quickcheck)
+}
+
+func (p *pipeline) mergedAlignJob(primary *cram_file, members []*cram_file) job_spec {
+	out_folder := "D_merged_realignments/" + strings.ReplaceAll(primary.Library_type, " ", "_") + "/"
+
+	// a cram that reaches alignment after the rest of its sample was merged,
+	// such as one from a run/lane added to the project later, is merged on its
+	// own, so the merged bam is named after its primary as well as the sample
+	merged_name := primary.Sample_name + "." + strings.TrimSuffix(primary.Filename, ".cram")
+	bam_output := out_folder + merged_name + ".bam"
+	var lane_bams []string
+	var lane_cmds []string
+	aligner := p.alignerProfile(primary.Library_type)
+	job_prefix := aligner.jobPrefix()
+	for _, cram := range members {
+		lane_folder := cram.Run_lane_dir + "/D_realignments/" + strings.ReplaceAll(cram.Library_type, " ", "_") + "/"
+		lane_bam := lane_folder + strings.TrimSuffix(cram.Filename, ".cram") + ".bam"
+
+		lane_cmds = append(lane_cmds, shellQuote([]string{"mkdir", "-p", lane_folder}))
+		lane_cmds = append(lane_cmds, p.alignLines(cram, aligner, lane_folder+cram.Filename, lane_bam)...)
+		lane_bams = append(lane_bams, lane_bam)
+		cram.Realigned_bam_path = bam_output
+	}
+
+	merge_cmd := append([]string{p.cfg.Samtools_exec, "merge", "-f", "-@3", "-l7", bam_output}, lane_bams...)
+	primary.Realigned_script_path = out_folder + job_prefix + merged_name + ".sh"
+
+	return scriptJob(job_spec{
+		Name:    job_prefix + merged_name,
+		Stdout:  out_folder + job_prefix + merged_name + ".o",
+		Stderr:  out_folder + job_prefix + merged_name + ".e",
+		Memory:  aligner.Memory,
+		Threads: aligner.Threads,
+	}, primary.Realigned_script_path, append(lane_cmds, shellQuote(merge_cmd)))
+}
+
+// syncMergedCrams copies the alignment, quickcheck, index and QC results of
+// each merged sample's primary cram onto the other crams merged into it, and
+// fails them at the same stage if the primary failed.
+func (p *pipeline) syncMergedCrams() {
+	crams := cramsOf(p.activeRunLanes())
+	primaries := make(map[string]*cram_file)
+	for _, cram := range crams {
+		primaries[cram.Filename] = cram
+	}
+	for _, cram := range crams {
+		if primary, ok := primaries[cram.Merged_into]; ok {
+			cram.Realigned_bam_path = primary.Realigned_bam_path
+			cram.Realigned_script_path = primary.Realigned_script_path
+			cram.Realigned_succesful = primary.Realigned_succesful
+			cram.Realigned_quickcheck_success = primary.Realigned_quickcheck_success
+			cram.Realigned_index_success = primary.Realigned_index_success
+			cram.Qc_metrics_collected = primary.Qc_metrics_collected
+			cram.Qc_metrics = primary.Qc_metrics
+			cram.Qc_flags = primary.Qc_flags
+			cram.Upload_irods_path = primary.Upload_irods_path
+			cram.Uploaded = primary.Uploaded
+
+			if primary.Stage == stage_failed && cram.Stage == stage_merged {
+				log.Printf("Stopping %s: merged sample %s failed\n", cram.Filename, primary.Filename)
+				cram.Failed_stage = primary.Failed_stage
+				cram.Stage = stage_failed
+			}
+		}
+	}
+}
+
+// rnaBams returns the bams to include in the counts matrix
+func (p *pipeline) rnaBams(crams []*cram_file) []string {
+	var rna_bams_featurecounts_input []string
+	for _, cram := range crams {
+		// if quickcheck worked then add its realigned and sorted bam path to list of bams to include in counts matrix,
+		// crams merged into another sample's bam are counted through that sample
+		if cram.Realigned_quickcheck_success && cram.Merged_into == "" {
+			if aligner := p.alignerProfile(cram.Library_type); aligner != nil && aligner.Rna {
+				rna_bams_featurecounts_input = append(rna_bams_featurecounts_input, cram.Realigned_bam_path)
+
+			}
+		}
+	}
+	return rna_bams_featurecounts_input
+}
+
+// countsAreCurrent reports whether the counts matrix was built from the given
+// bams, in which case it doesn't need to be rerun. A checkpoint that can't be
+// read, such as one left half written, is treated as out of date so that the
+// counts matrix is built again.
+func (p *pipeline) countsAreCurrent(checkpoint_file string, rna_bams []string) bool {
+	if !fileExists(checkpoint_file) {
+		return false
+	}
+	counted_crams, err := readCheckpoint(checkpoint_file)
+	if err != nil {
+		log.Printf("Unable to read %s, treating the counts matrix as out of date: %s\n", checkpoint_file, err.Error())
+		return false
+	}
+
+	var counted []*cram_file
+	for i := range counted_crams {
+		counted = append(counted, &counted_crams[i])
+	}
+	return reflect.DeepEqual(p.rnaBams(counted), rna_bams)
+}
+
+// threads featureCounts is run with
+const featurecounts_threads = 14
+
+var version_regex = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`)
+
+// versionAtLeast reports whether the first x.y.z version in version is at
+// least minimum, returning false if it has none
+func versionAtLeast(version string, minimum [3]int) bool {
+	match := version_regex.FindStringSubmatch(version)
+	if match == nil {
+		return false
+	}
+	for i := range minimum {
+		part, _ := strconv.Atoi(match[i+1])
+		if part != minimum[i] {
+			return part > minimum[i]
+		}
+	}
+	return true
+}
+
+// featureCountsCommand counts the reads of the bams into matrix_out. Paired
+// bams are counted by fragment, which from subread 2.0.2 needs --countReadPairs
+// as well as -p.
+func (p *pipeline) featureCountsCommand(bams []string, paired bool, matrix_out string) []string {
+	cmd := []string{
+		p.cfg.Featurecounts_exec,
+		"-T", strconv.Itoa(featurecounts_threads),
+		"-Q", "30",
+	}
+	if paired {
+		cmd = append(cmd, "-p")
+		if versionAtLeast(p.toolVersion(p.cfg.Featurecounts_exec, []string{"-v"}), [3]int{2, 0, 2}) {
+			cmd = append(cmd, "--countReadPairs")
+		}
+	}
+	cmd = append(cmd,
+		"-t", "exon",
+		"-g", "gene_name",
+		"-F", "GTF",
+		"-a", p.cfg.Genome_annot,
+		"-o", matrix_out)
+
+	// append bam paths to end of command options, as this is what featureCounts expects
+	return append(cmd, bams...)
+}
+
+// Build the featureCounts job that generates the counts matrix of RNA bams.
+// Paired and single-end bams can't be counted in the same featureCounts run,
+// so when there are both each are counted on their own and their counts
+// joined into one matrix and summary, as the rows of both are the genes of
+// the same annotation in the same order.
+func (p *pipeline) featureCountsJob(crams []*cram_file, rna_bams []string) job_spec {
+	matrix_out := counts_matrix_path
+	job_out := "E_Counts_matrix_RNA/featurecounts_run.o"
+	job_err := "E_Counts_matrix_RNA/featurecounts_run.e"
+
+	single_end := make(map[string]bool)
+	for _, cram := range crams {
+		if cram.Single_end && stringInSlice(cram.Realigned_bam_path, rna_bams) {
+			single_end[cram.Realigned_bam_path] = true
+		}
+	}
+	var paired_bams, single_end_bams []string
+	for _, bam := range rna_bams {
+		if single_end[bam] {
+			single_end_bams = append(single_end_bams, bam)
+		} else {
+			paired_bams = append(paired_bams, bam)
+		}
+	}
+
+	var lines []string
+	switch {
+	case len(single_end_bams) == 0:
+		lines = append(lines, shellQuote(p.featureCountsCommand(paired_bams, true, matrix_out)))
+	case len(paired_bams) == 0:
+		lines = append(lines, shellQuote(p.featureCountsCommand(single_end_bams, false, matrix_out)))
+	default:
+		paired_out := strings.TrimSuffix(matrix_out, ".tsv") + ".paired.tsv"
+		single_end_out := strings.TrimSuffix(matrix_out, ".tsv") + ".single_end.tsv"
+		lines = append(lines,
+			shellQuote(p.featureCountsCommand(paired_bams, true, paired_out)),
+			shellQuote(p.featureCountsCommand(single_end_bams, false, single_end_out)),
+			// the first 6 columns of the matrix, and the first of the summary,
+			// describe the gene or status rather than holding counts
+			"paste <(grep -v '^#' "+shellQuote([]string{paired_out})+") <(grep -v '^#' "+
+				shellQuote([]string{single_end_out})+" | cut -f 7-) > "+shellQuote([]string{matrix_out}),
+			"paste "+shellQuote([]string{paired_out + ".summary"})+" <(cut -f 2- "+
+				shellQuote([]string{single_end_out + ".summary"})+") > "+shellQuote([]string{matrix_out + ".summary"}),
+		)
+	}
+
+	return scriptJob(job_spec{
+		Name:    "E_featurecounts",
+		Stdout:  job_out,
+		Stderr:  job_err,
+		Memory:  p.cfg.Featurecounts_ram,
+		Threads: featurecounts_threads,
+	}, "E_Counts_matrix_RNA/featurecounts_run.sh", lines)
+}
+
+// Generate counts matrix of RNA bams. This is the only stage that waits for
+// every cram, and is done once for the whole project so its checkpoint is kept
+// in the project root. It is rerun whenever the bams it was built from change,
+// and skipped if there are none, as in projects of only DNA libraries.
+func (p *pipeline) countFeatures() error {
+	checkpoint_file := "checkpoint_counts.json"
+	crams := cramsOf(p.activeRunLanes())
+	rna_bams_featurecounts_input := p.rnaBams(crams)
+
+	if len(rna_bams_featurecounts_input) < 1 {
+		log.Println("No completed RNA bams, skipping featurecounts")
+		return nil
+	}
+
+	if p.countsAreCurrent(checkpoint_file, rna_bams_featurecounts_input) {
+		log.Println("Checkpoint exists for counts matrix, loading progress")
+		return p.uploadCounts(crams, rna_bams_featurecounts_input)
+	}
+
+	log.Println("Running featurecounts on completed RNA bams")
+
+	// if featurecounts exited successfuly write new checkpoint file
+	// this doesn't have any new information but its presence will indicate not to repeat the featurecounts step
+	job := p.featureCountsJob(crams, rna_bams_featurecounts_input)
+	exit_status, err := p.runProjectJob(checkpoint_file, "featurecounts", job, rna_bams_featurecounts_input)
+	if err != nil {
+		return fmt.Errorf("Featurecounts did not exit successfully: %s", err.Error())
+	}
+	if exit_status != 0 {
+		return fmt.Errorf("Featurecounts did not exit successfully, exit status %d", exit_status)
+	}
+	var cram_list []cram_file
+	for _, cram := range crams {
+		cram_list = append(cram_list, *cram)
+	}
+	writeCheckpoint(checkpoint_file, cram_list)
+	log.Println("Checkpoint saved for counts matrix")
+	return p.uploadCounts(crams, rna_bams_featurecounts_input)
+}
+
+// waitForJob polls the project's job until it has finished, returning its
+// exit status. It returns an error if the scheduler loses the job or it takes
+// longer than the stage's timeout, in which case it is cancelled. If
+// irods_downloader is interrupted the job is either left running, saved in
+// job_file, or cancelled, as set by on_interrupt.
+func (p *pipeline) waitForJob(job project_job, job_file string) (int, error) {
+	job_id, stage := job.Job_id, job.Stage
+	timeout := p.jobTimeout(stage)
+	for {
+		state, err := p.sched.Poll(job_id)
+		if err == nil && state == job_finished {
+			break
+		}
+		if err == nil && state == job_lost {
+			p.sched.Cancel(job_id)
+			return -1, fmt.Errorf("job %s was lost by the scheduler", job_id)
+		}
+		if timeout > 0 && time.Since(job.Submitted) > timeout {
+			if err := p.sched.Cancel(job_id); err != nil {
+				log.Println(err)
+			}
+			return -1, fmt.Errorf("job %s did not finish within %s", job_id, timeout)
+		}
+		if sig := p.sleep(5 * time.Second); sig != nil {
+			if p.cfg.On_interrupt == interrupt_detach && p.sched.Detachable() {
+				log.Printf("Leaving %s job %s running, which will be picked up by the next run\n", stage, job_id)
+			} else {
+				log.Printf("Cancelling %s job %s\n", stage, job_id)
+				if err := p.sched.Cancel(job_id); err != nil {
+					log.Println(err)
+				}
+				os.Remove(job_file)
+			}
+			p.interrupt(sig)
+		}
+	}
+	return p.sched.ExitStatus(job_id)
+}
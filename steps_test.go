@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/seanlaidlaw/iRODS-Downloader/irods"
+)
+
+// fake_irods holds the data objects of a test in a local directory, from
+// which download jobs copy them
+type fake_irods struct {
+	dir  string
+	avus map[string][]irods.Avu
+}
+
+func (c *fake_irods) localPath(irods_path string) string {
+	return filepath.Join(c.dir, filepath.Base(irods_path))
+}
+
+func (c *fake_irods) CheckAuth() error {
+	return nil
+}
+
+func (c *fake_irods) Query(conditions []irods.Condition) ([]irods.Data_object, error) {
+	var objects []irods.Data_object
+	for irods_path, avus := range c.avus {
+		matches := true
+		for _, condition := range conditions {
+			if value, _ := irods.AvuValue(avus, condition.Attribute); value != condition.Value {
+				matches = false
+			}
+		}
+		if matches {
+			objects = append(objects, irods.Data_object{Collection: filepath.Dir(irods_path), Name: filepath.Base(irods_path)})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+func (c *fake_irods) Exists(irods_path string) (bool, error) {
+	return fileExists(c.localPath(irods_path)), nil
+}
+
+func (c *fake_irods) Metadata(irods_path string) ([]irods.Avu, error) {
+	return c.avus[irods_path], nil
+}
+
+func (c *fake_irods) Checksum(irods_path string) (string, error) {
+	dat, err := ioutil.ReadFile(c.localPath(irods_path))
+	if err != nil {
+		return "", err
+	}
+	sum := md5.Sum(dat)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (c *fake_irods) DownloadCommand(irods_path string, local_path string) []string {
+	return []string{"cp", c.localPath(irods_path), local_path}
+}
+
+func (c *fake_irods) UploadCommand(local_path string, irods_path string) []string {
+	return []string{"cp", local_path, c.localPath(irods_path)}
+}
+
+func (c *fake_irods) MkdirCommand(collection string) []string {
+	return []string{"true"}
+}
+
+func (c *fake_irods) MetadataCommands(irods_path string, avus []irods.Avu) [][]string {
+	return nil
+}
+
+// stub_tools are scripts standing in for the tools jobs run: samtools writes
+// placeholder outputs, the aligner fails for samples named "bad", and
+// irods_downloader's checksum subcommand uses md5sum
+var stub_tools = map[string]string{
+	"samtools": `case "$1" in
+fastq)
+	while [ $# -gt 0 ]; do
+		case "$1" in -1|-2|-0) [ "$2" != /dev/null ] && echo "@r" > "$2"; shift;; esac
+		shift
+	done;;
+sort) while [ $# -gt 0 ]; do [ "$1" = -o ] && cat > "$2"; shift; done;;
+quickcheck) [ -s "$2" ];;
+index) touch "$2.bai";;
+flagstat) echo "1000 + 0 in total (QC-passed reads + QC-failed reads)";;
+stats) printf 'SN\traw total sequences:\t1000\nSN\treads mapped:\t750\nSN\treads properly paired:\t500\n';;
+idxstats) printf 'chr1\t1000\t700\t0\nchrM\t100\t50\t0\n';;
+esac`,
+	"aligner": `case "$1" in *bad*) exit 1;; esac
+echo "aligned $*"`,
+	"irods_downloader": `[ "$1" = checksum ] && md5sum "$2" | cut -d " " -f 1 > "$3"`,
+}
+
+// TestLocalPipeline runs a lane through every stage on the local scheduler,
+// with stub tools in place of samtools, the aligner and iRODS
+func TestLocalPipeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for name, script := range stub_tools {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := &fake_irods{dir: filepath.Join(dir, "irods"), avus: make(map[string][]irods.Avu)}
+	if err := os.Mkdir(client.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	samples := map[string][]string{
+		"1234_1#0.cram": {"phiX", "phix"},
+		"1234_1#1.cram": {"DNA", "s1"},
+		"1234_1#2.cram": {"DNA", "bad"},
+		"1234_1#3.cram": {"Other", "s3"},
+		"1234_2#1.cram": {"DNA", "other_lane"},
+	}
+	for name, sample := range samples {
+		irods_path := "/seq/1234/" + name
+		if err := ioutil.WriteFile(client.localPath(irods_path), []byte("cram of "+sample[1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		client.avus[irods_path] = []irods.Avu{
+			{Attribute: "id_run", Value: "1234"}, {Attribute: "lane", Value: name[5:6]}, {Attribute: "type", Value: "cram"},
+			{Attribute: "library_type", Value: sample[0]}, {Attribute: "sample", Value: sample[1]},
+			{Attribute: "is_paired_read", Value: "1"},
+		}
+	}
+
+	p := &pipeline{
+		cfg: pipeline_config{
+			Library_type_attribute:     "library_type",
+			Attribute_with_sample_name: "sample",
+			Paired_attribute:           "is_paired_read",
+			Samtools_exec:              filepath.Join(dir, "samtools"),
+			Aligners: map[string]*aligner_profile{
+				"stub": {Name: "stub", Exec: filepath.Join(dir, "aligner"), Args: []string{"{fastq_1}", "{fastq_2}"}, Threads: 1},
+			},
+			Library_aligners: map[string]string{"dna": "stub"},
+			Job_max_attempts: 2,
+			Retain_crams:     true,
+			Retain_fastqs:    true,
+		},
+		sched:      newLocalScheduler(2),
+		irods:      client,
+		executable: filepath.Join(dir, "irods_downloader"),
+		run_lanes:  []*run_lane{{Run: "1234", Lane: "1"}},
+	}
+
+	p.loadOrQuery()
+	deadline := time.Now().Add(time.Minute)
+	for _, cram := range cramsOf(p.run_lanes) {
+		for !stageIsFinal(cram.Stage) {
+			if p.advance(cram) {
+				continue
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s is still at stage %s", cram.Filename, cram.Stage)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	p.writeCheckpoints()
+
+	crams, err := readCheckpoint(p.run_lanes[0].checkpointPath())
+	if err != nil {
+		t.Fatalf("unable to read checkpoint: %s", err)
+	}
+	stages := make(map[string]string)
+	for _, cram := range crams {
+		stages[cram.Filename] = cram.Stage
+		if cram.Stage == stage_failed {
+			stages[cram.Filename] += " at " + cram.Failed_stage
+		}
+	}
+	want_stages := map[string]string{
+		"1234_1#0.cram": stage_skipped,
+		"1234_1#1.cram": stage_done,
+		"1234_1#2.cram": stage_failed + " at " + stage_align,
+		"1234_1#3.cram": stage_done,
+	}
+	if fmt.Sprint(stages) != fmt.Sprint(want_stages) {
+		t.Fatalf("crams finished at stages %v, want %v", stages, want_stages)
+	}
+
+	for _, cram := range crams {
+		switch cram.Filename {
+		case "1234_1#1.cram":
+			if !cram.Checksum_verified || !cram.Realigned_index_success || !fileExists(cram.Realigned_bam_path+".bai") {
+				t.Errorf("%s was not verified, aligned and indexed: %+v", cram.Filename, cram)
+			}
+			if dat, _ := ioutil.ReadFile(cram.Realigned_bam_path); !strings.Contains(string(dat), cram.Symlinked_fq_1) {
+				t.Errorf("bam of %s holds %q, want the output of aligning %s", cram.Filename, dat, cram.Symlinked_fq_1)
+			}
+			if cram.Qc_metrics == nil || cram.Qc_metrics.Mapping_percent != 75 {
+				t.Errorf("%s has QC metrics %+v, want a mapping percent of 75", cram.Filename, cram.Qc_metrics)
+			}
+		case "1234_1#2.cram":
+			cram.Stage = cram.Failed_stage
+			if attempts := stageAttempts(&cram); len(attempts) != 2 {
+				t.Errorf("%s was aligned %d times, want 2", cram.Filename, len(attempts))
+			}
+		case "1234_1#3.cram":
+			if cram.Realigned_bam_path != "" || !fileExists(cram.Symlinked_fq_1) {
+				t.Errorf("%s wasn't left at its extracted fastqs: %+v", cram.Filename, cram)
+			}
+		}
+	}
+}
+
+func TestCountsAreCurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &pipeline{cfg: pipeline_config{
+		Aligners:         map[string]*aligner_profile{"star": {Name: "star", Rna: true}},
+		Library_aligners: map[string]string{"rna": "star"},
+	}}
+	counted := []cram_file{{Library_type: "RNA", Realigned_quickcheck_success: true, Realigned_bam_path: "a.bam"}}
+	checkpoint := filepath.Join(dir, "checkpoint_counts.json")
+	writeCheckpoint(checkpoint, counted)
+
+	tests := []struct {
+		checkpoint string
+		rna_bams   []string
+		want       bool
+	}{
+		{checkpoint, []string{"a.bam"}, true},
+		{checkpoint, []string{"a.bam", "b.bam"}, false},
+		{filepath.Join(dir, "missing.json"), []string{"a.bam"}, false},
+		{filepath.Join(dir, "corrupt.json"), []string{"a.bam"}, false},
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "corrupt.json"), []byte(`[{"Filename": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		if got := p.countsAreCurrent(test.checkpoint, test.rna_bams); got != test.want {
+			t.Errorf("countsAreCurrent(%s, %v) = %v, want %v", filepath.Base(test.checkpoint), test.rna_bams, got, test.want)
+		}
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"featureCounts v2.0.1", false},
+		{"featureCounts v2.0.2", true},
+		{"featureCounts v2.1.0", true},
+		{"featureCounts v1.6.4", false},
+		{"featureCounts v10.0.0", true},
+		{"unknown", false},
+	}
+	for _, test := range tests {
+		if got := versionAtLeast(test.version, [3]int{2, 0, 2}); got != test.want {
+			t.Errorf("versionAtLeast(%q, 2.0.2) = %v, want %v", test.version, got, test.want)
+		}
+	}
+}
+
+func TestFeatureCountsJob(t *testing.T) {
+	paired := &cram_file{Realigned_bam_path: "a.bam"}
+	single_end := &cram_file{Realigned_bam_path: "b.bam", Single_end: true}
+	options := "-t exon -g gene_name -F GTF -a genes.gtf"
+	tests := []struct {
+		version string
+		crams   []*cram_file
+		want    []string
+	}{
+		{"featureCounts v2.0.1", []*cram_file{paired}, []string{
+			"featureCounts -T 14 -Q 30 -p " + options + " -o " + counts_matrix_path + " a.bam",
+		}},
+		{"featureCounts v2.0.3", []*cram_file{paired}, []string{
+			"featureCounts -T 14 -Q 30 -p --countReadPairs " + options + " -o " + counts_matrix_path + " a.bam",
+		}},
+		{"featureCounts v2.0.3", []*cram_file{single_end}, []string{
+			"featureCounts -T 14 -Q 30 " + options + " -o " + counts_matrix_path + " b.bam",
+		}},
+		{"featureCounts v2.0.1", []*cram_file{paired, single_end}, []string{
+			"featureCounts -T 14 -Q 30 -p " + options + " -o E_Counts_matrix_RNA/featurecounts_matrix.paired.tsv a.bam",
+			"featureCounts -T 14 -Q 30 " + options + " -o E_Counts_matrix_RNA/featurecounts_matrix.single_end.tsv b.bam",
+			"paste <(grep -v '^#' E_Counts_matrix_RNA/featurecounts_matrix.paired.tsv) " +
+				"<(grep -v '^#' E_Counts_matrix_RNA/featurecounts_matrix.single_end.tsv | cut -f 7-) > " + counts_matrix_path,
+			"paste E_Counts_matrix_RNA/featurecounts_matrix.paired.tsv.summary " +
+				"<(cut -f 2- E_Counts_matrix_RNA/featurecounts_matrix.single_end.tsv.summary) > " + counts_matrix_path + ".summary",
+		}},
+	}
+	for _, test := range tests {
+		p := &pipeline{
+			cfg:           pipeline_config{Featurecounts_exec: "featureCounts", Genome_annot: "genes.gtf"},
+			tool_versions: map[string]string{"featureCounts -v": test.version},
+		}
+		var bams []string
+		for _, cram := range test.crams {
+			bams = append(bams, cram.Realigned_bam_path)
+		}
+		job := p.featureCountsJob(test.crams, bams)
+		want := "#!/bin/bash\nset -euo pipefail\n" + strings.Join(test.want, "\n") + "\n"
+		if job.Script != want || job.Threads != 14 {
+			t.Errorf("featureCountsJob of %v with %s has script\n%s\nand %d threads, want\n%s", bams, test.version, job.Script, job.Threads, want)
+		}
+	}
+}
+
+func TestMergeGroup(t *testing.T) {
+	rl := &run_lane{Run: "1234", Lane: "1", crams: []cram_file{
+		{Filename: "1234_1#1.cram", Stage: stage_align, Library_type: "RNA", Sample_name: "s1"},
+		{Filename: "1234_1#2.cram", Stage: stage_align, Library_type: "RNA", Sample_name: "s1"},
+		{Filename: "1234_1#3.cram", Stage: stage_failed, Failed_stage: stage_fastq, Library_type: "RNA", Sample_name: "s1"},
+		{Filename: "1234_1#4.cram", Stage: stage_failed, Failed_stage: stage_qc, Library_type: "RNA", Sample_name: "s1"},
+		{Filename: "1234_1#5.cram", Stage: stage_align, Library_type: "RNA", Sample_name: "s2"},
+		{Filename: "1234_1#6.cram", Stage: stage_align, Library_type: "DNA", Sample_name: "s1"},
+	}}
+	p := &pipeline{run_lanes: []*run_lane{rl}}
+
+	members, missing, ready := p.mergeGroup(&rl.crams[0])
+	if !ready || len(members) != 2 || members[1] != &rl.crams[1] || len(missing) != 1 || missing[0] != &rl.crams[2] {
+		t.Errorf("mergeGroup returned members %v and missing %v (ready %v), want #1 and #2 merged without #3", members, missing, ready)
+	}
+
+	rl.crams[1].Stage = stage_fastq
+	if _, _, ready := p.mergeGroup(&rl.crams[0]); ready {
+		t.Errorf("mergeGroup is ready while a cram of the sample is still extracting its fastqs")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import "strings"
+
+// streamsFastqs reports whether the cram's reads are streamed from the CRAM
+// straight into its aligner, rather than extracted to fastqs first. Library
+// types that aren't aligned always have their fastqs extracted, as those are
+// their final output.
+func (p *pipeline) streamsFastqs(cram *cram_file) bool {
+	return p.cfg.Stream_fastqs && p.alignerProfile(cram.Library_type) != nil
+}
+
+// streamAlignLines returns the script lines that align the cram without
+// writing its fastqs to disk. The CRAM is collated so that mates are next to
+// each other and its reads written by samtools fastq to named pipes, which the
+// aligner reads in place of fastqs. The pipes are uncompressed, as gzip sees
+// a named pipe it opens before samtools as empty, so profiles that decompress
+// their fastqs need Stream_args. Waiting on the extraction makes the job fail
+// if it does, not only if the aligner does. If the aligner fails before
+// opening the pipes, samtools fastq would wait forever to open them, so the
+// extraction is killed whenever the script exits early.
+func (p *pipeline) streamAlignLines(cram *cram_file, aligner *aligner_profile, out_prefix string, bam_output string) []string {
+	cram.Fastqs_streamed = true
+	fifo_dir := strings.TrimSuffix(bam_output, ".bam") + ".fastq_stream"
+
+	fastq_1 := fifo_dir + "/1.fq"
+	fastq_2 := ""
+	fifos := []string{fastq_1}
+	fastq_cmd := []string{p.cfg.Samtools_exec, "fastq", "-@", "2"}
+	if cram.Single_end {
+		fastq_cmd = append(fastq_cmd, "-0", fastq_1)
+	} else {
+		fastq_2 = fifo_dir + "/2.fq"
+		fifos = append(fifos, fastq_2)
+		fastq_cmd = append(fastq_cmd, "-1", fastq_1, "-2", fastq_2, "-0", "/dev/null", "-s", "/dev/null")
+	}
+
+	var lines []string
+	if index_args := p.indexReadArgs(cram); len(index_args) > 0 {
+		// index reads are small, so are still written out for later use
+		lines = append(lines, shellQuote([]string{"mkdir", "-p", cram.Run_lane_dir + "/B_Fastq_Extraction"}))
+		fastq_cmd = append(fastq_cmd, index_args...)
+	}
+	fastq_cmd = append(fastq_cmd, "-n", "-")
+
+	collate_cmd := []string{p.cfg.Samtools_exec, "collate", "-O", "-u", "-@", "2", cram.Cram_dl_path, fifo_dir + "/collate"}
+	aligner_cmd := aligner.command(cram, fastq_1, fastq_2, out_prefix, p.readGroup(cram), true)
+
+	return append(lines,
+		shellQuote([]string{"rm", "-rf", fifo_dir}),
+		shellQuote([]string{"mkdir", "-p", fifo_dir}),
+		shellQuote(append([]string{"mkfifo"}, fifos...)),
+		shellQuote(collate_cmd)+" | "+shellQuote(fastq_cmd)+" &",
+		"extract_pid=$!",
+		// jobs -p gives the first command of the pipeline, $! the last
+		`trap 'kill $(jobs -p) "$extract_pid" 2>/dev/null || true' EXIT`,
+		shellQuote(aligner_cmd)+" | "+shellQuote(p.sortCommand(bam_output)),
+		`wait "$extract_pid"`,
+		"trap - EXIT",
+		shellQuote([]string{"rm", "-rf", fifo_dir}),
+	)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/seanlaidlaw/iRODS-Downloader/irods"
+)
+
+// queueUpload sends a cram that finished before upload_collection was
+// configured back to be uploaded
+func (p *pipeline) queueUpload(cram *cram_file) {
+	if p.cfg.Upload_collection != "" && cram.Stage == stage_done && cram.Realigned_index_success && !cram.Uploaded {
+		cram.Stage = stage_upload
+	}
+}
+
+// uploadIrodsPath is where a file in the project is uploaded to, which
+// mirrors its path under the project root
+func (p *pipeline) uploadIrodsPath(local_path string) string {
+	return path.Join(p.cfg.Upload_collection, filepath.ToSlash(local_path))
+}
+
+// toolVersion runs the executable with args and returns the version it
+// prints, taken from a "Version:" line if it has one or otherwise its first
+// line. Tools such as bwa only print their version in their usage, so the
+// exit status is ignored. Versions are cached, as each is needed for every bam.
+func (p *pipeline) toolVersion(executable string, args []string) string {
+	key := strings.Join(append([]string{executable}, args...), " ")
+	if version, ok := p.tool_versions[key]; ok {
+		return version
+	}
+
+	output, _ := exec.Command(executable, args...).CombinedOutput()
+	version := ""
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.Index(line, "Version:"); i >= 0 {
+			version = strings.TrimSpace(line[i+len("Version:"):])
+			break
+		}
+		if version == "" && line != "" {
+			version = line
+		}
+	}
+	if version == "" {
+		log.Printf("Unable to find the version of %s\n", executable)
+		version = "unknown"
+	}
+
+	if p.tool_versions == nil {
+		p.tool_versions = make(map[string]string)
+	}
+	p.tool_versions[key] = version
+	return version
+}
+
+// sourceAvus returns a source_data_object AVU for each of the crams, linking
+// an output back to the data objects it was made from
+func sourceAvus(crams []*cram_file) []irods.Avu {
+	var avus []irods.Avu
+	for _, cram := range crams {
+		avus = append(avus, irods.Avu{Attribute: "source_data_object", Value: cram.Irods_path})
+	}
+	return avus
+}
+
+// bamAvus returns the AVUs describing how the cram's bam was made: the data
+// objects it was aligned from, which for a merged sample are those of every
+// lane, its sample and library type, and the aligner, reference and tool
+// versions used.
+func (p *pipeline) bamAvus(cram *cram_file) []irods.Avu {
+	sources := []*cram_file{cram}
+	for _, other := range cramsOf(p.activeRunLanes()) {
+		if other.Merged_into == cram.Filename {
+			sources = append(sources, other)
+		}
+	}
+
+	avus := sourceAvus(sources)
+	avus = append(avus,
+		irods.Avu{Attribute: "sample", Value: cram.Sample_name},
+		irods.Avu{Attribute: "library_type", Value: cram.Library_type},
+	)
+	if aligner := p.alignerProfile(cram.Library_type); aligner != nil {
+		avus = append(avus,
+			irods.Avu{Attribute: "aligner", Value: aligner.Name},
+			irods.Avu{Attribute: "aligner_version", Value: p.toolVersion(aligner.Exec, aligner.Version_args)},
+			irods.Avu{Attribute: "reference", Value: aligner.Reference},
+		)
+	}
+	return append(avus, irods.Avu{
+		Attribute: "samtools_version",
+		Value:     p.toolVersion(p.cfg.Samtools_exec, []string{"--version"}),
+	})
+}
+
+// uploadLines returns the script lines that upload each of the files to
+// upload_collection and give them the AVUs
+func (p *pipeline) uploadLines(local_paths []string, avus []irods.Avu) []string {
+	var lines []string
+	for _, local_path := range local_paths {
+		irods_path := p.uploadIrodsPath(local_path)
+		lines = append(lines,
+			shellQuote(p.irods.MkdirCommand(path.Dir(irods_path))),
+			shellQuote(p.irods.UploadCommand(local_path, irods_path)),
+		)
+		for _, cmd := range p.irods.MetadataCommands(irods_path, avus) {
+			lines = append(lines, shellQuote(cmd))
+		}
+	}
+	return lines
+}
+
+// uploadJob uploads the cram's bam and its index to upload_collection, tagged
+// with where they came from
+func (p *pipeline) uploadJob(cram *cram_file) job_spec {
+	bam := cram.Realigned_bam_path
+	cram.Upload_irods_path = p.uploadIrodsPath(bam)
+
+	job_prefix := filepath.Dir(bam) + "/F_iRODS_upload_" + bamName(cram)
+	return scriptJob(job_spec{
+		Name:   "F_iRODS_upload_" + bamName(cram),
+		Stdout: job_prefix + ".o",
+		Stderr: job_prefix + ".e",
+		Memory: 1000,
+	}, job_prefix+".sh", p.uploadLines([]string{bam, bam + ".bai"}, p.bamAvus(cram)))
+}
+
+// countsUploadJob uploads the counts matrix and its summary to
+// upload_collection, tagged with the data objects of every bam counted
+func (p *pipeline) countsUploadJob(crams []*cram_file, rna_bams []string) job_spec {
+	var counted []*cram_file
+	for _, cram := range crams {
+		if stringInSlice(cram.Realigned_bam_path, rna_bams) {
+			counted = append(counted, cram)
+		}
+	}
+	avus := append(sourceAvus(counted),
+		irods.Avu{Attribute: "annotation", Value: p.cfg.Genome_annot},
+		irods.Avu{Attribute: "featurecounts_version", Value: p.toolVersion(p.cfg.Featurecounts_exec, []string{"-v"})},
+	)
+
+	matrix := counts_matrix_path
+	return scriptJob(job_spec{
+		Name:   "F_iRODS_upload_counts",
+		Stdout: "E_Counts_matrix_RNA/F_iRODS_upload_counts.o",
+		Stderr: "E_Counts_matrix_RNA/F_iRODS_upload_counts.e",
+		Memory: 1000,
+	}, "E_Counts_matrix_RNA/F_iRODS_upload_counts.sh", p.uploadLines([]string{matrix, matrix + ".summary"}, avus))
+}
+
+// uploadCounts uploads the counts matrix if an upload_collection is
+// configured and it hasn't already been uploaded for the same bams
+func (p *pipeline) uploadCounts(crams []*cram_file, rna_bams []string) error {
+	checkpoint_file := "checkpoint_counts_upload.json"
+	if p.cfg.Upload_collection == "" {
+		return nil
+	}
+	if p.countsAreCurrent(checkpoint_file, rna_bams) {
+		log.Println("Checkpoint exists for counts matrix upload, loading progress")
+		return nil
+	}
+
+	log.Println("Uploading counts matrix to iRODS")
+	job := p.countsUploadJob(crams, rna_bams)
+	exit_status, err := p.runProjectJob(checkpoint_file, "counts_upload", job, rna_bams)
+	if err != nil {
+		return fmt.Errorf("Upload of counts matrix did not exit successfully: %s", err.Error())
+	}
+	if exit_status != 0 {
+		return fmt.Errorf("Upload of counts matrix did not exit successfully, exit status %d", exit_status)
+	}
+	var cram_list []cram_file
+	for _, cram := range crams {
+		cram_list = append(cram_list, *cram)
+	}
+	writeCheckpoint(checkpoint_file, cram_list)
+	log.Println("Checkpoint saved for counts matrix upload")
+	return nil
+}